@@ -15,6 +15,8 @@ package kv
 
 import (
 	"io"
+
+	goctx "golang.org/x/net/context"
 )
 
 // Transaction options
@@ -125,6 +127,14 @@ type Request struct {
 	// ResponseIterator.Next is called. If concurrency is greater than 1, the request will be
 	// sent to multiple storage units concurrently.
 	Concurrency int
+	// If RegionParallelism is greater than 1, the key ranges in a single storage
+	// unit may be split into at most RegionParallelism requests, so they can be
+	// sent concurrently. Storages that cannot split requests ignore it.
+	RegionParallelism int
+	// Ctx is the context of the query that the request belongs to. Canceling
+	// it cancels all the requests sent to the storage units, including the
+	// running ones. Nil means the request cannot be canceled.
+	Ctx goctx.Context
 }
 
 // Response represents the response returned from KV layer.
@@ -883,3 +883,13 @@ const (
 	ErrRowInWrongPartition                                          = 1863
 	ErrErrorLast                                                    = 1863
 )
+
+// TiDB specific error codes of the storage layer.
+const (
+	ErrPDServerTimeout    = 9001
+	ErrTiKVServerTimeout  = 9002
+	ErrTiKVServerBusy     = 9003
+	ErrResolveLockTimeout = 9004
+	ErrRegionUnavailable  = 9005
+	ErrGCTooEarly         = 9006
+)
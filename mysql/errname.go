@@ -879,4 +879,12 @@ var MySQLErrName = map[uint16]string{
 	ErrAlterOperationNotSupportedReasonNotNull:               "cannot silently convert NULL values, as required in this SQLMODE",
 	ErrMustChangePasswordLogin:                               "Your password has expired. To log in you must change it using a client that supports expired passwords.",
 	ErrRowInWrongPartition:                                   "Found a row in wrong partition %s",
+
+	// TiDB errors.
+	ErrPDServerTimeout:    "PD server timeout",
+	ErrTiKVServerTimeout:  "TiKV server timeout",
+	ErrTiKVServerBusy:     "TiKV server is busy",
+	ErrResolveLockTimeout: "Resolve lock timeout",
+	ErrRegionUnavailable:  "Region is unavailable",
+	ErrGCTooEarly:         "Snapshot is older than GC safe point",
 }
@@ -195,3 +195,25 @@ func (s *testCommitterSuite) TestContextCancelRetryable(c *C) {
 	c.Assert(err, NotNil)
 	c.Assert(strings.Contains(err.Error(), txnRetryableMark), IsTrue)
 }
+
+func (s *testCommitterSuite) TestLocalLatches(c *C) {
+	s.store.txnLatches = newLatches(256)
+	defer func() { s.store.txnLatches = nil }()
+
+	txn1 := s.begin(c)
+	txn2 := s.begin(c)
+	c.Assert(txn1.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn2.Set([]byte("a"), []byte("a2")), IsNil)
+	c.Assert(txn1.Commit(), IsNil)
+
+	// txn2 fails by the latches without being prewritten.
+	err := txn2.Commit()
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "local latches"), IsTrue)
+	s.checkValues(c, map[string]string{"a": "a1"})
+
+	txn3 := s.begin(c)
+	c.Assert(txn3.Set([]byte("a"), []byte("a3")), IsNil)
+	c.Assert(txn3.Commit(), IsNil)
+	s.checkValues(c, map[string]string{"a": "a3"})
+}
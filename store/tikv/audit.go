@@ -0,0 +1,151 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"golang.org/x/net/context"
+)
+
+// Outcomes of a request recorded in AuditRecord.
+const (
+	AuditSuccess     = "success"
+	AuditRegionError = "region_error"
+	AuditError       = "error"
+)
+
+// AuditRecord describes a finished request sent by RegionRequestSender.
+type AuditRecord struct {
+	// Principal is read from the request's context, see WithAuditPrincipal.
+	Principal string
+	Type      string
+	RegionID  uint64
+	StartTime time.Time
+	Duration  time.Duration
+	// StoreAddr is the address of the store which served the last attempt.
+	StoreAddr string
+	Retries   int
+	Outcome   string
+	Err       string
+}
+
+// AuditSink receives an AuditRecord for each request. Record is called in the
+// request goroutine, so it should not block.
+type AuditSink interface {
+	Record(r *AuditRecord)
+}
+
+type auditPrincipalKey struct{}
+
+// WithAuditPrincipal returns a context carrying the principal which will be
+// recorded for requests sent with it.
+func WithAuditPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, auditPrincipalKey{}, principal)
+}
+
+func auditPrincipal(ctx context.Context) string {
+	p, _ := ctx.Value(auditPrincipalKey{}).(string)
+	return p
+}
+
+// BufferedAuditSink forwards records to another sink in a background
+// goroutine. Records are dropped if the buffer is full or the sink is closed.
+type BufferedAuditSink struct {
+	sink    AuditSink
+	ch      chan *AuditRecord
+	dropped uint64
+	done    chan struct{}
+	mu      struct {
+		sync.RWMutex
+		closed bool
+	}
+}
+
+// NewBufferedAuditSink wraps sink so that Record never blocks. At most size
+// records are buffered, the rest are dropped and counted.
+func NewBufferedAuditSink(sink AuditSink, size int) *BufferedAuditSink {
+	s := &BufferedAuditSink{
+		sink: sink,
+		ch:   make(chan *AuditRecord, size),
+		done: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Record implements AuditSink interface.
+func (s *BufferedAuditSink) Record(r *AuditRecord) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.mu.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	select {
+	case s.ch <- r:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Close stops the background goroutine after the buffered records are
+// forwarded, and waits for it to exit.
+func (s *BufferedAuditSink) Close() {
+	s.mu.Lock()
+	if !s.mu.closed {
+		s.mu.closed = true
+		close(s.ch)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *BufferedAuditSink) run() {
+	defer close(s.done)
+	for r := range s.ch {
+		s.sink.Record(r)
+	}
+}
+
+// Dropped returns the number of records dropped because the buffer was full.
+func (s *BufferedAuditSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *RegionRequestSender) audit(tp string, regionID RegionVerID, start time.Time, regionErr *errorpb.Error, err error) {
+	if s.AuditSink == nil {
+		return
+	}
+	r := &AuditRecord{
+		Principal: auditPrincipal(s.bo.ctx),
+		Type:      tp,
+		RegionID:  regionID.id,
+		StartTime: start,
+		Duration:  time.Since(start),
+		StoreAddr: s.storeAddr,
+		Retries:   s.retries,
+		Outcome:   AuditSuccess,
+	}
+	if err != nil {
+		r.Outcome, r.Err = AuditError, err.Error()
+	} else if regionErr != nil {
+		r.Outcome, r.Err = AuditRegionError, regionErr.String()
+	}
+	s.AuditSink.Record(r)
+}
@@ -20,6 +20,8 @@ import (
 
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/terror"
 	"golang.org/x/net/context"
 )
 
@@ -38,6 +40,17 @@ const (
 // optional jitters.
 // See http://www.awsarchitectureblog.com/2015/03/backoff.html
 func NewBackoffFn(base, cap, jitter int) func() int {
+	next := newBackoffSeq(base, cap, jitter)
+	return func() int {
+		sleep := next()
+		time.Sleep(time.Duration(sleep) * time.Millisecond)
+		return sleep
+	}
+}
+
+// newBackoffSeq is like NewBackoffFn, but the returned func only computes the
+// next sleep time without sleeping.
+func newBackoffSeq(base, cap, jitter int) func() int {
 	attempts := 0
 	lastSleep := base
 	return func() int {
@@ -54,7 +67,6 @@ func NewBackoffFn(base, cap, jitter int) func() int {
 		case DecorrJitter:
 			sleep = int(math.Min(float64(cap), float64(base+rand.Intn(lastSleep*3-base))))
 		}
-		time.Sleep(time.Duration(sleep) * time.Millisecond)
 
 		attempts++
 		lastSleep = sleep
@@ -79,15 +91,15 @@ const (
 func (t backoffType) createFn() func() int {
 	switch t {
 	case boTiKVRPC:
-		return NewBackoffFn(100, 2000, EqualJitter)
+		return newBackoffSeq(100, 2000, EqualJitter)
 	case boTxnLock:
-		return NewBackoffFn(300, 3000, EqualJitter)
+		return newBackoffSeq(300, 3000, EqualJitter)
 	case boPDRPC:
-		return NewBackoffFn(500, 3000, EqualJitter)
+		return newBackoffSeq(500, 3000, EqualJitter)
 	case boRegionMiss:
-		return NewBackoffFn(100, 500, NoJitter)
+		return newBackoffSeq(100, 500, NoJitter)
 	case boServerBusy:
-		return NewBackoffFn(2000, 10000, EqualJitter)
+		return newBackoffSeq(2000, 10000, EqualJitter)
 	}
 	return nil
 }
@@ -108,6 +120,24 @@ func (t backoffType) String() string {
 	return ""
 }
 
+// terror returns the error that causes the error of an exhausted backoff of
+// the type.
+func (t backoffType) terror() *terror.Error {
+	switch t {
+	case boTiKVRPC:
+		return ErrTiKVServerTimeout
+	case boTxnLock:
+		return ErrResolveLockTimeout
+	case boPDRPC:
+		return ErrPDServerTimeout
+	case boRegionMiss:
+		return ErrRegionUnavailable
+	case boServerBusy:
+		return ErrTiKVServerBusy
+	}
+	return terror.ClassTiKV.New(mysql.ErrUnknown, mysql.MySQLErrName[mysql.ErrUnknown])
+}
+
 // Maximum total sleep time(in ms) for kv/cop commands.
 const (
 	copBuildTaskMaxBackoff  = 5000
@@ -122,6 +152,7 @@ const (
 	gcMaxBackoff            = 100000
 	gcResolveLockMaxBackoff = 100000
 	rawkvMaxBackoff         = 5000
+	warmUpMaxBackoff        = 5000
 )
 
 // Backoffer is a utility for retrying queries.
@@ -129,8 +160,10 @@ type Backoffer struct {
 	fn         map[backoffType]func() int
 	maxSleep   int
 	totalSleep int
-	errors     []error
-	ctx        context.Context
+	// typeSleep is the total sleep time of each backoffType.
+	typeSleep map[backoffType]int
+	errors    []error
+	ctx       context.Context
 }
 
 // NewBackoffer creates a Backoffer with maximum sleep time(in ms).
@@ -149,8 +182,17 @@ func (b *Backoffer) WithCancel() context.CancelFunc {
 }
 
 // Backoff sleeps a while base on the backoffType and records the error message.
-// It returns a retryable error if total sleep time exceeds maxSleep.
+// It returns a retryable error if total sleep time exceeds maxSleep, or
+// ctx.Err() if the context of Backoffer is done while sleeping.
 func (b *Backoffer) Backoff(typ backoffType, err error) error {
+	return b.backoffWith(typ, typ.createFn, 0, err)
+}
+
+// backoffWith is like Backoff, but uses createFn to create the backoff func if
+// the Backoffer has not backed off on typ yet. The created func returns the
+// time to sleep, see newBackoffSeq. If maxTypeSleep is positive, it also
+// returns a retryable error once the total sleep time of typ exceeds it.
+func (b *Backoffer) backoffWith(typ backoffType, createFn func() func() int, maxTypeSleep int, err error) error {
 	backoffCounter.WithLabelValues(typ.String()).Inc()
 	start := time.Now()
 	defer func() { backoffHistogram.WithLabelValues(typ.String()).Observe(time.Since(start).Seconds()) }()
@@ -160,26 +202,60 @@ func (b *Backoffer) Backoff(typ backoffType, err error) error {
 	}
 	f, ok := b.fn[typ]
 	if !ok {
-		f = typ.createFn()
+		f = createFn()
 		b.fn[typ] = f
 	}
 
-	b.totalSleep += f()
+	sleep := f()
+	select {
+	case <-time.After(time.Duration(sleep) * time.Millisecond):
+	case <-b.ctx.Done():
+		return errors.Trace(b.ctx.Err())
+	}
+	b.totalSleep += sleep
+	if b.typeSleep == nil {
+		b.typeSleep = make(map[backoffType]int)
+	}
+	b.typeSleep[typ] += sleep
 
 	log.Warnf("%v, retry later(totalSleep %dms, maxSleep %dms)", err, b.totalSleep, b.maxSleep)
 	b.errors = append(b.errors, err)
 	if b.totalSleep >= b.maxSleep {
-		e := errors.Errorf("backoffer.maxSleep %dms is exceeded, errors: %v", b.maxSleep, b.errors)
+		e := b.longestType().terror().Gen("backoffer.maxSleep %dms is exceeded, errors: %v", b.maxSleep, b.errors)
+		return errors.Annotate(e, txnRetryableMark)
+	}
+	if maxTypeSleep > 0 && b.typeSleep[typ] >= maxTypeSleep {
+		e := typ.terror().Gen("backoffer.maxSleep %dms of %v is exceeded, errors: %v", maxTypeSleep, typ, b.errors)
 		return errors.Annotate(e, txnRetryableMark)
 	}
 	return nil
 }
 
+// longestType returns the backoffType that has slept the longest.
+func (b *Backoffer) longestType() backoffType {
+	var longest backoffType
+	max := -1
+	for typ, sleep := range b.typeSleep {
+		if sleep > max || (sleep == max && typ < longest) {
+			longest, max = typ, sleep
+		}
+	}
+	return longest
+}
+
 // Fork creates a new Backoffer which keeps current Backoffer's sleep time and errors.
 func (b *Backoffer) Fork() *Backoffer {
+	var typeSleep map[backoffType]int
+	if b.typeSleep != nil {
+		typeSleep = make(map[backoffType]int, len(b.typeSleep))
+		for typ, sleep := range b.typeSleep {
+			typeSleep[typ] = sleep
+		}
+	}
 	return &Backoffer{
 		maxSleep:   b.maxSleep,
 		totalSleep: b.totalSleep,
+		typeSleep:  typeSleep,
 		errors:     b.errors,
 		ctx:        b.ctx,
 	}
@@ -0,0 +1,269 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// The defaults of SenderConfig.CircuitBreakerWindow and
+// SenderConfig.CircuitBreakerCooldown.
+const (
+	defaultCircuitBreakerWindow   = 10 * time.Second
+	defaultCircuitBreakerCooldown = 5 * time.Second
+)
+
+// CircuitStatus is the status of the circuit breaker of a store.
+type CircuitStatus int
+
+// CircuitStatus values.
+const (
+	// CircuitClosed lets requests be sent to the store.
+	CircuitClosed CircuitStatus = iota
+	// CircuitOpen skips the store until the cooldown ends.
+	CircuitOpen
+	// CircuitHalfOpen lets one request be sent to the store after the
+	// cooldown. Its success closes the circuit, its failure opens it again.
+	CircuitHalfOpen
+)
+
+func (s CircuitStatus) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitState is the state of the circuit breaker of a store, see
+// RegionCache.CircuitStates.
+type CircuitState struct {
+	StoreID   uint64
+	StoreAddr string
+	Status    CircuitStatus
+	// Failures is the number of failures within the current window, which
+	// open the circuit when they reach SenderConfig.CircuitBreakerFailures.
+	Failures int
+	// NextProbe is the time until an open circuit turns half-open. It's zero
+	// if the circuit is not open.
+	NextProbe time.Duration
+}
+
+type circuitBreaker struct {
+	// addr is the address of the store when the breaker is created. It's
+	// reset if the store moves to another address.
+	addr      string
+	failures  int
+	firstFail time.Time
+	openUntil time.Time
+	// probing is set when a request is sent to a half-open store.
+	probing bool
+}
+
+func (b *circuitBreaker) state(now time.Time) CircuitStatus {
+	switch {
+	case b.openUntil.IsZero():
+		return CircuitClosed
+	case now.Before(b.openUntil):
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+type circuitBreakerMap struct {
+	sync.Mutex
+	m map[uint64]*circuitBreaker
+}
+
+// CircuitStates returns the states of the circuit breakers of the stores known
+// to the cache, including the closed ones, ordered by store ID.
+func (c *RegionCache) CircuitStates() []CircuitState {
+	states := make(map[uint64]*CircuitState)
+	c.stores.RLock()
+	for id, store := range c.stores.m {
+		states[id] = &CircuitState{StoreID: id, StoreAddr: store.GetAddress()}
+	}
+	c.stores.RUnlock()
+
+	c.breakers.Lock()
+	now := time.Now()
+	for id, b := range c.breakers.m {
+		s, ok := states[id]
+		if !ok {
+			s = &CircuitState{StoreID: id, StoreAddr: b.addr}
+			states[id] = s
+		}
+		s.Status, s.Failures = b.state(now), b.failures
+		if s.Status == CircuitOpen {
+			s.NextProbe = b.openUntil.Sub(now)
+		}
+	}
+	c.breakers.Unlock()
+
+	ret := make([]CircuitState, 0, len(states))
+	for _, s := range states {
+		ret = append(ret, *s)
+	}
+	sort.Sort(circuitStates(ret))
+	return ret
+}
+
+type circuitStates []CircuitState
+
+func (s circuitStates) Len() int           { return len(s) }
+func (s circuitStates) Less(i, j int) bool { return s[i].StoreID < s[j].StoreID }
+func (s circuitStates) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ResetCircuit closes the circuit breaker of the store and clears its
+// failures.
+func (c *RegionCache) ResetCircuit(storeID uint64) {
+	c.breakers.Lock()
+	defer c.breakers.Unlock()
+
+	if b, ok := c.breakers.m[storeID]; ok {
+		delete(c.breakers.m, storeID)
+		log.Infof("circuit breaker of store %d (%s) is reset", storeID, b.addr)
+	}
+}
+
+// circuitAllow returns whether a request can be sent to the store. The first
+// call after the cooldown is allowed as the probe of the half-open store,
+// unless cfg.CircuitBreakerBackgroundProbe is set.
+func (c *RegionCache) circuitAllow(storeID uint64, cfg *SenderConfig) bool {
+	c.breakers.Lock()
+	defer c.breakers.Unlock()
+
+	b, ok := c.breakers.m[storeID]
+	if !ok {
+		return true
+	}
+	switch b.state(time.Now()) {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if b.probing || cfg.CircuitBreakerBackgroundProbe {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// reportCircuit records the result of sending a request to the store. The
+// circuit opens after cfg.CircuitBreakerFailures failures within
+// cfg.CircuitBreakerWindow, and a success closes it.
+func (c *RegionCache) reportCircuit(storeID uint64, addr string, ok bool, cfg *SenderConfig) {
+	c.breakers.Lock()
+	defer c.breakers.Unlock()
+
+	if ok {
+		delete(c.breakers.m, storeID)
+		return
+	}
+	b, exist := c.breakers.m[storeID]
+	if !exist || b.addr != addr {
+		b = &circuitBreaker{addr: addr}
+		c.breakers.m[storeID] = b
+	}
+	now := time.Now()
+	if b.state(now) == CircuitHalfOpen {
+		b.openUntil, b.probing = now.Add(cfg.circuitBreakerCooldown()), false
+		log.Warnf("circuit breaker of %s opens again", addr)
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFail) > cfg.circuitBreakerWindow() {
+		b.failures, b.firstFail = 0, now
+	}
+	b.failures++
+	if b.failures >= cfg.CircuitBreakerFailures && b.openUntil.IsZero() {
+		b.openUntil = now.Add(cfg.circuitBreakerCooldown())
+		log.Warnf("send to %s failed %d times, circuit breaker opens", addr, b.failures)
+	}
+}
+
+// reportCircuitProbe records the result of a HealthSweeper probe of the store.
+// It only affects a half-open circuit: a success closes it, a failure opens it
+// again. Probes do not open circuits, which is left to requests.
+func (c *RegionCache) reportCircuitProbe(storeID uint64, ok bool, cfg *SenderConfig) {
+	c.breakers.Lock()
+	defer c.breakers.Unlock()
+
+	b, exist := c.breakers.m[storeID]
+	if !exist || b.state(time.Now()) != CircuitHalfOpen {
+		return
+	}
+	if ok {
+		delete(c.breakers.m, storeID)
+		log.Infof("probe of %s succeeded, circuit breaker closes", b.addr)
+		return
+	}
+	b.openUntil, b.probing = time.Now().Add(cfg.circuitBreakerCooldown()), false
+}
+
+// skipOpenCircuit moves the request off a store whose circuit is open, without
+// sending it. With ReadOnlyCache, it fails with ErrCircuitOpen instead.
+func (s *RegionRequestSender) skipOpenCircuit(region *Region) error {
+	if s.ReadOnlyCache {
+		return errors.Annotatef(ErrCircuitOpen, "store %s", s.storeAddr)
+	}
+	log.Warnf("circuit breaker of %s is open, region %d try next peer later", s.storeAddr, region.GetID())
+	s.regionCache.NextPeer(region.VerID())
+	s.meta.TouchedPD = true
+	// Back off as for a send failure, or the request spins between the open
+	// store and a follower that keeps redirecting to it.
+	err := s.backoff(boTiKVRPC, errors.Errorf("circuit breaker of %s is open, region %d, try next peer later", s.storeAddr, region.GetID()))
+	return errors.Trace(err)
+}
+
+// circuitOpen returns whether requests are kept off the store. Unlike
+// circuitAllow, it does not take the probe of a half-open circuit.
+func (c *RegionCache) circuitOpen(storeID uint64, cfg *SenderConfig) bool {
+	c.breakers.Lock()
+	defer c.breakers.Unlock()
+
+	b, ok := c.breakers.m[storeID]
+	if !ok {
+		return false
+	}
+	switch b.state(time.Now()) {
+	case CircuitOpen:
+		return true
+	case CircuitHalfOpen:
+		return b.probing || cfg.CircuitBreakerBackgroundProbe
+	}
+	return false
+}
+
+// peerCircuitOpen returns whether the circuit of the store of the region's
+// peer is open.
+func (s *RegionRequestSender) peerCircuitOpen(region *Region, peerID uint64) bool {
+	if s.cfg.CircuitBreakerFailures <= 0 {
+		return false
+	}
+	for _, p := range region.meta.GetPeers() {
+		if p.GetId() == peerID {
+			return s.regionCache.circuitOpen(p.GetStoreId(), s.cfg)
+		}
+	}
+	return false
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/msgpb"
 	"github.com/pingcap/kvproto/pkg/util"
+	"golang.org/x/net/context"
 )
 
 // Client is a client that sends RPC.
@@ -31,10 +32,49 @@ import (
 type Client interface {
 	// Close should release all data.
 	Close() error
-	// SendKVReq sends kv request.
-	SendKVReq(addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error)
-	// SendCopReq sends coprocessor request.
-	SendCopReq(addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error)
+	// SendKVReq sends kv request. It returns ctx.Err() if ctx is done before
+	// the response is received.
+	SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error)
+	// SendCopReq sends coprocessor request. It returns ctx.Err() if ctx is
+	// done before the response is received.
+	SendCopReq(ctx context.Context, addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error)
+	// RecycleConn closes the connections to addr after they are used, so
+	// following requests use new connections.
+	RecycleConn(addr string)
+}
+
+// notSentError marks a send error that happens before the request is written
+// to the connection, e.g. failing to dial, so the request is surely not
+// received by tikv.
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string {
+	return e.err.Error()
+}
+
+// Cause implements the causer interface of juju errors.
+func (e *notSentError) Cause() error {
+	return errors.Cause(e.err)
+}
+
+// isNotSent returns whether err is returned by Client before sending the
+// request.
+func isNotSent(err error) bool {
+	for err != nil {
+		if _, ok := err.(*notSentError); ok {
+			return true
+		}
+		u, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return false
+		}
+		err = u.Underlying()
+	}
+	return false
 }
 
 const (
@@ -61,20 +101,23 @@ func newRPCClient() *rpcClient {
 }
 
 // SendCopReq sends a Request to co-processor and receives Response.
-func (c *rpcClient) SendCopReq(addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error) {
+func (c *rpcClient) SendCopReq(ctx context.Context, addr string, req *coprocessor.Request, timeout time.Duration) (resp *coprocessor.Response, err error) {
 	start := time.Now()
-	defer func() { sendReqHistogram.WithLabelValues("cop").Observe(time.Since(start).Seconds()) }()
+	defer func() { observeRequest("cop", "cop", addr, start, err != nil || resp.GetRegionError() != nil) }()
 
+	if err = ctx.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
 	conn, err := c.p.GetConn(addr)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, errors.Trace(&notSentError{err: err})
 	}
 	defer c.p.PutConn(conn)
 	msg := msgpb.Message{
 		MsgType: msgpb.MessageType_CopReq,
 		CopReq:  req,
 	}
-	err = c.doSend(conn, &msg, writeTimeout, timeout)
+	err = c.doSend(ctx, conn, &msg, writeTimeout, timeout)
 	if err != nil {
 		conn.Close()
 		return nil, errors.Trace(err)
@@ -87,20 +130,25 @@ func (c *rpcClient) SendCopReq(addr string, req *coprocessor.Request, timeout ti
 }
 
 // SendKVReq sends a Request to kv server and receives Response.
-func (c *rpcClient) SendKVReq(addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+func (c *rpcClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (resp *kvrpcpb.Response, err error) {
 	start := time.Now()
-	defer func() { sendReqHistogram.WithLabelValues("kv").Observe(time.Since(start).Seconds()) }()
+	defer func() {
+		observeRequest("kv", req.GetType().String(), addr, start, err != nil || resp.GetRegionError() != nil)
+	}()
 
+	if err = ctx.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
 	conn, err := c.p.GetConn(addr)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, errors.Trace(&notSentError{err: err})
 	}
 	defer c.p.PutConn(conn)
 	msg := msgpb.Message{
 		MsgType: msgpb.MessageType_KvReq,
 		KvReq:   req,
 	}
-	err = c.doSend(conn, &msg, writeTimeout, timeout)
+	err = c.doSend(ctx, conn, &msg, writeTimeout, timeout)
 	if err != nil {
 		conn.Close()
 		return nil, errors.Trace(err)
@@ -112,7 +160,29 @@ func (c *rpcClient) SendKVReq(addr string, req *kvrpcpb.Request, timeout time.Du
 	return msg.GetKvResp(), nil
 }
 
-func (c *rpcClient) doSend(conn *Conn, msg *msgpb.Message, writeTimeout time.Duration, readTimeout time.Duration) error {
+func (c *rpcClient) doSend(ctx context.Context, conn *Conn, msg *msgpb.Message, writeTimeout time.Duration, readTimeout time.Duration) (err error) {
+	// Interrupt the blocking write/read by closing the underlying net.Conn if
+	// ctx is done. Caller closes the Conn since an error is returned. A ctx
+	// that is never done, e.g. context.Background(), needs no watcher.
+	if ctxDone := ctx.Done(); ctxDone != nil {
+		done := make(chan struct{})
+		var canceled int32
+		go func() {
+			select {
+			case <-ctxDone:
+				atomic.StoreInt32(&canceled, 1)
+				conn.nc.Close()
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			if err != nil && atomic.LoadInt32(&canceled) == 1 {
+				err = errors.Trace(ctx.Err())
+			}
+		}()
+	}
+
 	curMsgID := atomic.AddUint64(&c.msgID, 1)
 	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	if err := util.WriteMessage(conn, curMsgID, msg); err != nil {
@@ -133,6 +203,11 @@ func (c *rpcClient) doSend(conn *Conn, msg *msgpb.Message, writeTimeout time.Dur
 	return nil
 }
 
+// RecycleConn implements Client interface.
+func (c *rpcClient) RecycleConn(addr string) {
+	c.p.Recycle(addr)
+}
+
 func (c *rpcClient) Close() error {
 	c.p.Close()
 	return nil
@@ -16,12 +16,15 @@ package tikv
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/juju/errors"
 	"github.com/ngaut/log"
 	. "github.com/pingcap/check"
 	pb "github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/msgpb"
 	"github.com/pingcap/kvproto/pkg/util"
+	"golang.org/x/net/context"
 )
 
 func TestT(t *testing.T) {
@@ -68,7 +71,7 @@ func (s *testClientSuite) TestSendBySelf(c *C) {
 	ver := uint64(0)
 	getReq.Version = ver
 	req.CmdGetReq = getReq
-	resp, err := cli.SendKVReq(":61234", req, readTimeoutShort)
+	resp, err := cli.SendKVReq(context.Background(), ":61234", req, readTimeoutShort)
 	c.Assert(err, IsNil)
 	c.Assert(req.GetType(), Equals, resp.GetType())
 }
@@ -85,7 +88,7 @@ func (s *testClientSuite) TestRetryClose(c *C) {
 	defer l.Close()
 	cli := newRPCClient()
 	req := new(pb.Request)
-	resp, err := cli.SendKVReq(":61235", req, readTimeoutShort)
+	resp, err := cli.SendKVReq(context.Background(), ":61235", req, readTimeoutShort)
 	c.Assert(err, NotNil)
 	c.Assert(resp, IsNil)
 }
@@ -107,9 +110,16 @@ func (s *testClientSuite) TestRetryReadThenClose(c *C) {
 	cli := newRPCClient()
 	req := new(pb.Request)
 	req.Type = pb.MessageType_CmdGet
-	resp, err := cli.SendKVReq(":61236", req, readTimeoutShort)
+	resp, err := cli.SendKVReq(context.Background(), ":61236", req, readTimeoutShort)
 	c.Assert(err, NotNil)
 	c.Assert(resp, IsNil)
+	// The request may have been received.
+	c.Assert(isNotSent(err), IsFalse)
+
+	// Nothing is listening, the request is surely not sent.
+	_, err = cli.SendKVReq(context.Background(), ":61239", req, readTimeoutShort)
+	c.Assert(err, NotNil)
+	c.Assert(isNotSent(err), IsTrue)
 }
 
 func (s *testClientSuite) TestWrongMessageID(c *C) {
@@ -138,9 +148,9 @@ func (s *testClientSuite) TestWrongMessageID(c *C) {
 		Type: pb.MessageType_CmdGet,
 	}
 	// Wrong ID for the first request, correct for the rests.
-	_, err := cli.SendKVReq(":61237", req, readTimeoutShort)
+	_, err := cli.SendKVReq(context.Background(), ":61237", req, readTimeoutShort)
 	c.Assert(err, NotNil)
-	resp, err := cli.SendKVReq(":61237", req, readTimeoutShort)
+	resp, err := cli.SendKVReq(context.Background(), ":61237", req, readTimeoutShort)
 	c.Assert(err, IsNil)
 	c.Assert(resp.GetType(), Equals, req.GetType())
 }
@@ -160,3 +170,53 @@ func startServer(host string, c *C, handleFunc func(net.Conn, *C)) net.Listener
 	}()
 	return l
 }
+
+func (s *testClientSuite) TestMetricsSample(c *C) {
+	defer SetMetricsSampleRate(1)
+
+	ok, weight := requestSample(false)
+	c.Assert(ok, IsTrue)
+	c.Assert(weight, Equals, float64(1))
+
+	SetMetricsSampleRate(0.25)
+	var sampled int
+	var total float64
+	for i := 0; i < 10000; i++ {
+		if ok, weight := requestSample(false); ok {
+			sampled++
+			total += weight
+		}
+	}
+	c.Assert(sampled > 2000 && sampled < 3000, IsTrue, Commentf("sampled %d", sampled))
+	c.Assert(total, Equals, float64(sampled)*4)
+
+	// Failed requests are always recorded.
+	ok, weight = requestSample(true)
+	c.Assert(ok, IsTrue)
+	c.Assert(weight, Equals, float64(1))
+
+	SetMetricsSampleRate(0)
+	ok, _ = requestSample(false)
+	c.Assert(ok, IsTrue)
+}
+
+func (s *testClientSuite) TestCancel(c *C) {
+	l := startServer(":61238", c, func(conn net.Conn, c *C) {
+		// Read the request but never respond.
+		var msg msgpb.Message
+		_, err := util.ReadMessage(conn, &msg)
+		c.Assert(err, IsNil)
+	})
+	defer l.Close()
+	cli := newRPCClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := cli.SendKVReq(ctx, ":61238", &pb.Request{Type: pb.MessageType_CmdGet}, readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+	c.Assert(time.Since(start), Less, time.Second)
+
+	// A canceled context fails the request before sending it.
+	_, err = cli.SendKVReq(ctx, ":61238", &pb.Request{Type: pb.MessageType_CmdGet}, readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+}
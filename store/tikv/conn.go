@@ -33,6 +33,9 @@ type Conn struct {
 	closed bool
 	r      *bufio.Reader
 	w      *bufio.Writer
+	// gen is the generation of the addr when the Conn is created, see
+	// Pools.Recycle.
+	gen uint64
 }
 
 // NewConnection creates a Conn with dial timeout.
@@ -41,8 +44,9 @@ func NewConnection(addr string, dialTimeout time.Duration) (*Conn, error) {
 }
 
 // NewConnectionWithSize creates a Conn with dial timeout and read/write buffer size.
+// The connection uses TLS if it's enabled by SetSecurity.
 func NewConnectionWithSize(addr string, dialTimeout time.Duration, readSize int, writeSize int) (*Conn, error) {
-	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	conn, err := dialTLS(addr, dialTimeout)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -80,6 +80,9 @@ type Pools struct {
 		sync.Mutex
 		capability int
 		mpools     map[string]*Pool
+		// gens are bumped by Recycle, Conns of older generations are
+		// closed instead of being reused.
+		gens map[string]uint64
 	}
 	f createConnFunc
 }
@@ -91,6 +94,7 @@ func NewPools(capability int, f createConnFunc) *Pools {
 	p.f = f
 	p.m.capability = capability
 	p.m.mpools = make(map[string]*Pool)
+	p.m.gens = make(map[string]uint64)
 	return p
 }
 
@@ -99,12 +103,46 @@ func (p *Pools) GetConn(addr string) (*Conn, error) {
 	p.m.Lock()
 	pool, ok := p.m.mpools[addr]
 	if !ok {
-		pool = NewPool(addr, p.m.capability, p.f)
+		pool = NewPool(addr, p.m.capability, func(addr string) (*Conn, error) {
+			gen := p.gen(addr)
+			c, err := p.f(addr)
+			if c != nil {
+				c.gen = gen
+			}
+			return c, err
+		})
 		p.m.mpools[addr] = pool
 	}
 	p.m.Unlock()
 
-	return pool.GetConn()
+	for {
+		c, err := pool.GetConn()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if c.gen >= p.gen(addr) {
+			return c, nil
+		}
+		// Put the closed Conn back so the pool creates a new one.
+		c.Close()
+		pool.PutConn(c)
+	}
+}
+
+// Recycle makes all Conns to addr, idle or in use, be closed instead of being
+// reused, so following requests use new connections.
+func (p *Pools) Recycle(addr string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.m.gens[addr]++
+}
+
+func (p *Pools) gen(addr string) uint64 {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.m.gens[addr]
 }
 
 // PutConn puts a connection back to the pool.
@@ -118,9 +156,12 @@ func (p *Pools) PutConn(c *Conn) {
 	p.m.Unlock()
 	if !ok {
 		c.Close()
-	} else {
-		pool.PutConn(c)
+		return
+	}
+	if c.gen < p.gen(c.addr) {
+		c.Close()
 	}
+	pool.PutConn(c)
 }
 
 // Close closes the pool.
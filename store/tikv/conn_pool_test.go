@@ -93,3 +93,34 @@ func (s *testPoolSuite) TestPool(c *C) {
 	_, err = p.GetConn()
 	c.Assert(err, NotNil)
 }
+
+func (s *testPoolSuite) TestPoolsRecycle(c *C) {
+	count := 0
+	f := func(addr string) (*Conn, error) {
+		count++
+		return &Conn{addr: addr, closed: false, nc: &testDummyConn{}}, nil
+	}
+	addr := "127.0.0.1:6379"
+	p := NewPools(2, f)
+	defer p.Close()
+
+	idle, err := p.GetConn(addr)
+	c.Assert(err, IsNil)
+	inUse, err := p.GetConn(addr)
+	c.Assert(err, IsNil)
+	p.PutConn(idle)
+	c.Assert(count, Equals, 2)
+
+	p.Recycle(addr)
+	// The in-use connection is closed when it is put back.
+	p.PutConn(inUse)
+	c.Assert(inUse.closed, IsTrue)
+	// The idle connection is closed instead of being reused.
+	conn, err := p.GetConn(addr)
+	c.Assert(err, IsNil)
+	c.Assert(idle.closed, IsTrue)
+	c.Assert(conn.closed, IsFalse)
+	c.Assert(count, Equals, 3)
+	p.PutConn(conn)
+	c.Assert(conn.closed, IsFalse)
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+)
+
+const defaultCopCacheAdmissionMaxSize = 64 * 1024
+
+// copCache caches coprocessor responses, see SenderConfig.CopCacheCapacity.
+// Requests are keyed by the region version and a digest of the request. The
+// request data carries the read ts, and a snapshot never changes once it's
+// read without meeting a lock, so a cached response is what tikv would return
+// again.
+type copCache struct {
+	sync.Mutex
+	entries map[copCacheKey]*list.Element
+	// lru holds the *copCacheEntry of entries, the most recently used first.
+	lru *list.List
+	// size is the total size of the cached response data.
+	size int
+}
+
+type copCacheKey struct {
+	region RegionVerID
+	digest [sha256.Size]byte
+}
+
+type copCacheEntry struct {
+	key  copCacheKey
+	resp *coprocessor.Response
+}
+
+func newCopCacheKey(region RegionVerID, req *coprocessor.Request) copCacheKey {
+	h := sha256.New()
+	var b [8]byte
+	writeBytes := func(data []byte) {
+		binary.BigEndian.PutUint64(b[:], uint64(len(data)))
+		h.Write(b[:])
+		h.Write(data)
+	}
+	binary.BigEndian.PutUint64(b[:], uint64(req.GetTp()))
+	h.Write(b[:])
+	writeBytes(req.GetData())
+	for _, r := range req.GetRanges() {
+		writeBytes(r.GetStart())
+		writeBytes(r.GetEnd())
+	}
+	key := copCacheKey{region: region}
+	h.Sum(key.digest[:0])
+	return key
+}
+
+// get returns a copy of the cached response.
+func (c *copCache) get(key copCacheKey) (*coprocessor.Response, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return proto.Clone(elem.Value.(*copCacheEntry).resp).(*coprocessor.Response), true
+}
+
+// put caches resp. The least recently used entries are evicted if the
+// cached data is larger than capacity.
+func (c *copCache) put(key copCacheKey, resp *coprocessor.Response, capacity int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[copCacheKey]*list.Element)
+		c.lru = list.New()
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	e := &copCacheEntry{key: key, resp: proto.Clone(resp).(*coprocessor.Response)}
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += len(resp.GetData())
+	for c.size > capacity && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *copCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*copCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= len(e.resp.GetData())
+}
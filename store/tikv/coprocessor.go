@@ -76,16 +76,22 @@ func supportExpr(exprType tipb.ExprType) bool {
 func (c *CopClient) Send(req *kv.Request) kv.Response {
 	coprocessorCounter.WithLabelValues("send").Inc()
 
-	bo := NewBackoffer(copBuildTaskMaxBackoff, context.Background())
+	ctx := req.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	bo := NewBackoffer(copBuildTaskMaxBackoff, ctx)
 	tasks, err := buildCopTasks(bo, c.store.regionCache, &copRanges{mid: req.KeyRanges}, req.Desc)
 	if err != nil {
 		return copErrorResponse{err}
 	}
+	tasks = splitTasksInRegion(tasks, req.RegionParallelism, req.Desc)
 	it := &copIterator{
 		store:       c.store,
 		req:         req,
 		concurrency: req.Concurrency,
 	}
+	it.ctx, it.cancel = context.WithCancel(ctx)
 	it.mu.tasks = tasks
 	if it.concurrency > len(tasks) {
 		it.concurrency = len(tasks)
@@ -281,6 +287,46 @@ func buildCopTasks(bo *Backoffer, cache *RegionCache, ranges *copRanges, desc bo
 	return tasks, nil
 }
 
+// splitTasksInRegion splits the ranges of each task into at most n tasks on
+// the same region, so a large region can be processed concurrently. The
+// order of tasks is kept, every task is rebuilt on its own if its region is
+// stale.
+func splitTasksInRegion(tasks []*copTask, n int, desc bool) []*copTask {
+	if n <= 1 {
+		return tasks
+	}
+	var result []*copTask
+	for _, t := range tasks {
+		l := t.ranges.len()
+		if l <= 1 {
+			result = append(result, t)
+			continue
+		}
+		size := (l + n - 1) / n
+		var subTasks []*copTask
+		for from := 0; from < l; from += size {
+			to := from + size
+			if to > l {
+				to = l
+			}
+			subTasks = append(subTasks, &copTask{
+				region:   t.region,
+				status:   taskNew,
+				ranges:   t.ranges.slice(from, to),
+				respChan: make(chan *coprocessor.Response, 1),
+			})
+		}
+		if desc {
+			reverseTasks(subTasks)
+		}
+		result = append(result, subTasks...)
+	}
+	for i, t := range result {
+		t.idx = i
+	}
+	return result
+}
+
 func reverseTasks(tasks []*copTask) {
 	for i := 0; i < len(tasks)/2; i++ {
 		j := len(tasks) - i - 1
@@ -301,6 +347,16 @@ type copIterator struct {
 	}
 	respChan chan *coprocessor.Response
 	errChan  chan error
+	// ctx is derived from the context of kv.Request, it's canceled when the
+	// iterator is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// slowStores limits the running tasks on slow stores, see
+	// SenderConfig.SlowStoreP99.
+	slowStores struct {
+		sync.Mutex
+		sems map[uint64]chan struct{}
+	}
 }
 
 // Pick the next new copTask and send request to tikv-server.
@@ -311,22 +367,35 @@ func (it *copIterator) work() {
 			it.mu.Unlock()
 			break
 		}
-		// Find the next task to send.
-		var task *copTask
+		// Find the next task to send. Tasks on slow stores that are running
+		// as many tasks as allowed are picked only if there is no other.
+		cfg := it.store.regionCache.senderConfig()
+		var task, fallback *copTask
 		for _, t := range it.mu.tasks {
-			if t.status == taskNew {
+			if t.status != taskNew {
+				continue
+			}
+			if fallback == nil {
+				fallback = t
+			}
+			if !it.storeSaturated(cfg, t.region.peer.GetStoreId()) {
 				task = t
 				break
 			}
 		}
+		if task == nil {
+			task = fallback
+		}
 		if task == nil {
 			it.mu.Unlock()
 			break
 		}
 		task.status = taskRunning
 		it.mu.Unlock()
-		bo := NewBackoffer(copNextMaxBackoff, context.Background())
+		release := it.acquireStore(cfg, task.region.peer.GetStoreId())
+		bo := NewBackoffer(cfg.copMaxBackoff(), it.ctx)
 		resp, err := it.handleTask(bo, task)
+		release()
 		if err != nil {
 			it.errChan <- err
 			break
@@ -339,6 +408,53 @@ func (it *copIterator) work() {
 	}
 }
 
+// storeSlow returns whether the p99 latency of the store exceeds
+// cfg.SlowStoreP99.
+func (it *copIterator) storeSlow(cfg *SenderConfig, storeID uint64) bool {
+	if cfg.SlowStoreP99 <= 0 {
+		return false
+	}
+	p99, ok := it.store.regionCache.StoreLatencyP99(storeID)
+	return ok && p99 > cfg.SlowStoreP99
+}
+
+// storeSaturated returns whether the store is slow and running as many tasks
+// as allowed.
+func (it *copIterator) storeSaturated(cfg *SenderConfig, storeID uint64) bool {
+	if !it.storeSlow(cfg, storeID) {
+		return false
+	}
+	it.slowStores.Lock()
+	defer it.slowStores.Unlock()
+	sem := it.slowStores.sems[storeID]
+	return sem != nil && len(sem) >= cap(sem)
+}
+
+// acquireStore waits until a task can run on the store if it's slow, and
+// returns the func to call when the task is done.
+func (it *copIterator) acquireStore(cfg *SenderConfig, storeID uint64) (release func()) {
+	if !it.storeSlow(cfg, storeID) {
+		return func() {}
+	}
+	it.slowStores.Lock()
+	if it.slowStores.sems == nil {
+		it.slowStores.sems = make(map[uint64]chan struct{})
+	}
+	sem, ok := it.slowStores.sems[storeID]
+	if !ok {
+		sem = make(chan struct{}, cfg.slowStoreConcurrency())
+		it.slowStores.sems[storeID] = sem
+	}
+	it.slowStores.Unlock()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }
+	case <-it.ctx.Done():
+		// The task fails with the context's error soon.
+		return func() {}
+	}
+}
+
 func (it *copIterator) run() {
 	// Start it.concurrency number of workers to handle cop requests.
 	for i := 0; i < it.concurrency; i++ {
@@ -413,6 +529,7 @@ func (it *copIterator) Next() (io.ReadCloser, error) {
 // Handle single copTask.
 func (it *copIterator) handleTask(bo *Backoffer, task *copTask) (*coprocessor.Response, error) {
 	coprocessorCounter.WithLabelValues("handle_task").Inc()
+	sender := NewRegionRequestSender(bo, it.store.regionCache, it.store.client)
 	for {
 		it.mu.RLock()
 		if it.mu.finished {
@@ -422,48 +539,26 @@ func (it *copIterator) handleTask(bo *Backoffer, task *copTask) (*coprocessor.Re
 		it.mu.RUnlock()
 
 		req := &coprocessor.Request{
-			Context: task.region.GetContext(),
-			Tp:      it.req.Tp,
-			Data:    it.req.Data,
-			Ranges:  task.ranges.toPBRanges(),
+			Tp:     it.req.Tp,
+			Data:   it.req.Data,
+			Ranges: task.ranges.toPBRanges(),
 		}
-		resp, err := it.store.client.SendCopReq(task.region.GetAddress(), req, readTimeoutMedium)
-		if err != nil {
-			it.store.regionCache.NextPeer(task.region.VerID())
-			err = bo.Backoff(boTiKVRPC, err)
-			if err != nil {
-				return nil, errors.Trace(err)
+		cfg := it.store.regionCache.senderConfig()
+		var cacheKey copCacheKey
+		if cfg.CopCacheCapacity > 0 {
+			cacheKey = newCopCacheKey(task.region.VerID(), req)
+			if resp, ok := it.store.regionCache.cops.get(cacheKey); ok {
+				copCacheCounter.WithLabelValues("hit").Inc()
+				return resp, nil
 			}
-			err = it.rebuildCurrentTask(bo, task)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			log.Warnf("send coprocessor request error: %v, try next peer later", err)
-			continue
+			copCacheCounter.WithLabelValues("miss").Inc()
 		}
-		if e := resp.GetRegionError().GetServerIsBusy(); e != nil {
-			log.Warnf("tikv reports `ServerIsBusy`, ctx: %s, retry later", req.Context)
-			err = bo.Backoff(boServerBusy, errors.Errorf("server is busy"))
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			continue
+		start := time.Now()
+		resp, err := sender.SendCopReq(req, task.region.VerID(), readTimeoutMedium)
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
 		if e := resp.GetRegionError(); e != nil {
-			reportRegionError(e)
-			if notLeader := e.GetNotLeader(); notLeader != nil {
-				log.Warnf("tikv reports `NotLeader`: %s, ctx: %s, retry later", notLeader, req.Context)
-				it.store.regionCache.UpdateLeader(task.region.VerID(), notLeader.GetLeader().GetId())
-			} else if staleEpoch := e.GetStaleEpoch(); staleEpoch != nil {
-				log.Warnf("tikv reports `StaleEpoch`, ctx: %s, retry later", req.Context)
-				err = it.store.regionCache.OnRegionStale(task.region, staleEpoch.NewRegions)
-				if err != nil {
-					return nil, errors.Trace(err)
-				}
-			} else {
-				log.Warnf("tikv reports region error: %s, ctx: %s, retry later", e, req.Context)
-				it.store.regionCache.DropRegion(task.region.VerID())
-			}
 			err = bo.Backoff(boRegionMiss, errors.Errorf("regionError: %s", e))
 			if err != nil {
 				return nil, errors.Trace(err)
@@ -494,6 +589,11 @@ func (it *copIterator) handleTask(bo *Backoffer, task *copTask) (*coprocessor.Re
 			log.Warnf("coprocessor err: %v", err)
 			return nil, errors.Trace(err)
 		}
+		if cfg.CopCacheCapacity > 0 && len(resp.GetData()) <= cfg.copCacheAdmissionMaxSize() &&
+			time.Since(start) >= cfg.CopCacheAdmissionMinTime {
+			it.store.regionCache.cops.put(cacheKey, resp, cfg.CopCacheCapacity)
+			copCacheCounter.WithLabelValues("admit").Inc()
+		}
 		return resp, nil
 	}
 }
@@ -506,6 +606,7 @@ func (it *copIterator) rebuildCurrentTask(bo *Backoffer, task *copTask) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	newTasks = splitTasksInRegion(newTasks, it.req.RegionParallelism, it.req.Desc)
 	if len(newTasks) == 0 {
 		// TODO: check this, this should never happen.
 		return nil
@@ -531,6 +632,9 @@ func (it *copIterator) Close() error {
 	it.mu.Lock()
 	it.mu.finished = true
 	it.mu.Unlock()
+	if it.cancel != nil {
+		it.cancel()
+	}
 	return nil
 }
 
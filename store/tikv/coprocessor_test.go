@@ -14,7 +14,10 @@
 package tikv
 
 import (
+	"time"
+
 	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/store/tikv/mock-tikv"
 	"golang.org/x/net/context"
@@ -155,6 +158,39 @@ func (s *testCoprocessorSuite) buildKeyRanges(keys ...string) *copRanges {
 	return &copRanges{mid: ranges}
 }
 
+func (s *testCoprocessorSuite) TestSplitTasksInRegion(c *C) {
+	// nil --- 'g' --- nil
+	// <-  0  -> <- 1 ->
+	cluster := mocktikv.NewCluster()
+	_, regionIDs, _ := mocktikv.BootstrapWithMultiRegions(cluster, []byte("g"))
+	pdCli := &codecPDClient{mocktikv.NewPDClient(cluster)}
+	cache := NewRegionCache(pdCli)
+	bo := NewBackoffer(3000, context.Background())
+
+	ranges := s.buildKeyRanges("a", "b", "c", "d", "e", "f", "h", "k", "m", "n")
+	tasks, err := buildCopTasks(bo, cache, ranges, false)
+	c.Assert(err, IsNil)
+	c.Assert(splitTasksInRegion(tasks, 1, false), HasLen, 2)
+	tasks = splitTasksInRegion(tasks, 2, false)
+	c.Assert(tasks, HasLen, 4)
+	s.taskEqual(c, tasks[0], regionIDs[0], "a", "b", "c", "d")
+	s.taskEqual(c, tasks[1], regionIDs[0], "e", "f")
+	s.taskEqual(c, tasks[2], regionIDs[1], "h", "k")
+	s.taskEqual(c, tasks[3], regionIDs[1], "m", "n")
+	for i, t := range tasks {
+		c.Assert(t.idx, Equals, i)
+	}
+
+	tasks, err = buildCopTasks(bo, cache, ranges, true)
+	c.Assert(err, IsNil)
+	tasks = splitTasksInRegion(tasks, 2, true)
+	c.Assert(tasks, HasLen, 4)
+	s.taskEqual(c, tasks[0], regionIDs[1], "m", "n")
+	s.taskEqual(c, tasks[1], regionIDs[1], "h", "k")
+	s.taskEqual(c, tasks[2], regionIDs[0], "e", "f")
+	s.taskEqual(c, tasks[3], regionIDs[0], "a", "b", "c", "d")
+}
+
 func (s *testCoprocessorSuite) taskEqual(c *C, task *copTask, regionID uint64, keys ...string) {
 	c.Assert(task.region.GetID(), Equals, regionID)
 	for i := 0; i < task.ranges.len(); i++ {
@@ -190,3 +226,120 @@ func (s *testCoprocessorSuite) checkEqual(c *C, copRanges *copRanges, ranges []k
 		}
 	}
 }
+
+func (s *testCoprocessorSuite) TestSlowStoreThrottle(c *C) {
+	cluster := mocktikv.NewCluster()
+	storeID, _, _ := mocktikv.BootstrapWithSingleStore(cluster)
+	cache := NewRegionCache(mocktikv.NewPDClient(cluster))
+	it := &copIterator{store: &tikvStore{regionCache: cache}}
+	var cancel context.CancelFunc
+	it.ctx, cancel = context.WithCancel(context.Background())
+	cfg := &SenderConfig{SlowStoreP99: 100 * time.Millisecond, SlowStoreConcurrency: 2}
+
+	// Fast stores are not throttled.
+	cache.reportStoreResult(storeID, time.Millisecond, true)
+	c.Assert(it.storeSlow(cfg, storeID), IsFalse)
+	it.acquireStore(cfg, storeID)
+	it.acquireStore(cfg, storeID)
+	c.Assert(it.storeSaturated(cfg, storeID), IsFalse)
+
+	cache.reportStoreResult(storeID, time.Second, true)
+	c.Assert(it.storeSlow(cfg, storeID), IsTrue)
+	release1 := it.acquireStore(cfg, storeID)
+	c.Assert(it.storeSaturated(cfg, storeID), IsFalse)
+	it.acquireStore(cfg, storeID)
+	c.Assert(it.storeSaturated(cfg, storeID), IsTrue)
+	release1()
+	c.Assert(it.storeSaturated(cfg, storeID), IsFalse)
+	it.acquireStore(cfg, storeID)
+
+	// Waiting is aborted when the iterator is closed.
+	time.AfterFunc(10*time.Millisecond, cancel)
+	it.acquireStore(cfg, storeID)()
+	c.Assert(it.ctx.Err(), NotNil)
+
+	c.Assert(it.storeSlow(&SenderConfig{}, storeID), IsFalse)
+}
+
+func (s *testCoprocessorSuite) TestCopCache(c *C) {
+	var cache copCache
+	region := RegionVerID{id: 1, confVer: 1, ver: 1}
+	req := func(data string) *coprocessor.Request {
+		return &coprocessor.Request{Tp: kv.ReqTypeSelect, Data: []byte(data)}
+	}
+	k1, k2 := newCopCacheKey(region, req("1")), newCopCacheKey(region, req("2"))
+	c.Assert(k1, Not(Equals), k2)
+	c.Assert(newCopCacheKey(RegionVerID{id: 1, confVer: 1, ver: 2}, req("1")), Not(Equals), k1)
+
+	cache.put(k1, &coprocessor.Response{Data: []byte("aa")}, 4)
+	cache.put(k2, &coprocessor.Response{Data: []byte("bb")}, 4)
+	resp, ok := cache.get(k1)
+	c.Assert(ok, IsTrue)
+	c.Assert(resp.Data, DeepEquals, []byte("aa"))
+	// The copy returned can be modified.
+	resp.Data[0] = 'x'
+
+	// k2 is the least recently used.
+	k3 := newCopCacheKey(region, req("3"))
+	cache.put(k3, &coprocessor.Response{Data: []byte("cc")}, 4)
+	_, ok = cache.get(k2)
+	c.Assert(ok, IsFalse)
+	resp, ok = cache.get(k1)
+	c.Assert(ok, IsTrue)
+	c.Assert(resp.Data, DeepEquals, []byte("aa"))
+	c.Assert(cache.size, Equals, 4)
+}
+
+type copCountClient struct {
+	Client
+	count int
+}
+
+func (c *copCountClient) SendCopReq(ctx context.Context, addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error) {
+	c.count++
+	return &coprocessor.Response{Data: []byte("data")}, nil
+}
+
+func (s *testCoprocessorSuite) TestCopCacheHandleTask(c *C) {
+	cluster := mocktikv.NewCluster()
+	mocktikv.BootstrapWithSingleStore(cluster)
+	client := &copCountClient{Client: mocktikv.NewRPCClient(cluster, mocktikv.NewMvccStore())}
+	store, err := newTikvStore("mock-tikv-store", &codecPDClient{mocktikv.NewPDClient(cluster)}, client, false)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	defer ReconfigureSender(SenderConfig{})
+
+	bo := NewBackoffer(copNextMaxBackoff, context.Background())
+	send := func(data string) {
+		tasks, err := buildCopTasks(bo, store.regionCache, s.buildKeyRanges("a", "z"), false)
+		c.Assert(err, IsNil)
+		it := &copIterator{store: store, req: &kv.Request{Tp: kv.ReqTypeSelect, Data: []byte(data)}}
+		resp, err := it.handleTask(bo, tasks[0])
+		c.Assert(err, IsNil)
+		c.Assert(resp.Data, DeepEquals, []byte("data"))
+	}
+
+	// Disabled by default.
+	send("q1")
+	send("q1")
+	c.Assert(client.count, Equals, 2)
+
+	ReconfigureSender(SenderConfig{CopCacheCapacity: 1024})
+	send("q1")
+	send("q1")
+	c.Assert(client.count, Equals, 3)
+	send("q2")
+	c.Assert(client.count, Equals, 4)
+
+	// Responses larger than the admission size are not cached.
+	ReconfigureSender(SenderConfig{CopCacheCapacity: 1024, CopCacheAdmissionMaxSize: 2})
+	send("q3")
+	send("q3")
+	c.Assert(client.count, Equals, 6)
+
+	// Nor are responses that are computed quickly.
+	ReconfigureSender(SenderConfig{CopCacheCapacity: 1024, CopCacheAdmissionMinTime: time.Minute})
+	send("q4")
+	send("q4")
+	c.Assert(client.count, Equals, 8)
+}
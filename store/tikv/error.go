@@ -16,6 +16,8 @@ package tikv
 import (
 	"github.com/juju/errors"
 	pb "github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/terror"
 )
 
 var (
@@ -25,8 +27,61 @@ var (
 	errInvalidResponse = errors.New("invalid response")
 	// errBodyMissing response body is missing error
 	errBodyMissing = errors.New("response body is missing")
+	// ErrInvalidRequest is returned if a request is found to miss fields
+	// required by its type before it is sent.
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrNoPeerAvailable is returned if the cached region has no peer that a
+	// request can be sent to.
+	ErrNoPeerAvailable = errors.New("no peer available")
+	// ErrRegionReloadTimeout is returned if loading a region from PD takes
+	// longer than the reload timeout of RegionCache.
+	ErrRegionReloadTimeout = errors.New("region reload timeout")
+	// ErrInsufficientReplicas is returned if a write request is not sent
+	// because too few replicas of the region are reachable, see
+	// RegionRequestSender.MinHealthyReplicas.
+	ErrInsufficientReplicas = errors.New("insufficient healthy replicas")
+	// ErrRetryExhausted is returned if a request is retried more times or
+	// longer than allowed, see RegionRequestSender.MaxRetries.
+	ErrRetryExhausted = errors.New("retry exhausted")
+	// ErrResultUndetermined is returned if sending a write request fails
+	// after it may have been received by tikv, so whether it's applied is
+	// unknown, see RegionRequestSender.StrictWriteRetry.
+	ErrResultUndetermined = errors.New("result undetermined")
+	// ErrCircuitOpen is returned if a request is not sent because the
+	// circuit breaker of the store is open, see
+	// SenderConfig.CircuitBreakerFailures.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+	// ErrUnknownRegionError is returned if tikv reports a region error of a
+	// type that retrying does not fix, such as a raft entry being too large.
+	ErrUnknownRegionError = errors.New("unknown region error")
 )
 
+// Errors with MySQL error codes. The errors of exhausted backoffs are caused
+// by them, see backoffType.terror, so callers can tell why a request fails
+// and clients get a proper error code.
+var (
+	ErrPDServerTimeout    = terror.ClassTiKV.New(mysql.ErrPDServerTimeout, mysql.MySQLErrName[mysql.ErrPDServerTimeout])
+	ErrTiKVServerTimeout  = terror.ClassTiKV.New(mysql.ErrTiKVServerTimeout, mysql.MySQLErrName[mysql.ErrTiKVServerTimeout])
+	ErrTiKVServerBusy     = terror.ClassTiKV.New(mysql.ErrTiKVServerBusy, mysql.MySQLErrName[mysql.ErrTiKVServerBusy])
+	ErrResolveLockTimeout = terror.ClassTiKV.New(mysql.ErrResolveLockTimeout, mysql.MySQLErrName[mysql.ErrResolveLockTimeout])
+	ErrRegionUnavailable  = terror.ClassTiKV.New(mysql.ErrRegionUnavailable, mysql.MySQLErrName[mysql.ErrRegionUnavailable])
+	// ErrGCTooEarly is returned if a snapshot is older than the GC safe
+	// point, so the versions it reads may have been collected.
+	ErrGCTooEarly = terror.ClassTiKV.New(mysql.ErrGCTooEarly, mysql.MySQLErrName[mysql.ErrGCTooEarly])
+)
+
+func init() {
+	tikvMySQLErrCodes := map[terror.ErrCode]uint16{
+		mysql.ErrPDServerTimeout:    mysql.ErrPDServerTimeout,
+		mysql.ErrTiKVServerTimeout:  mysql.ErrTiKVServerTimeout,
+		mysql.ErrTiKVServerBusy:     mysql.ErrTiKVServerBusy,
+		mysql.ErrResolveLockTimeout: mysql.ErrResolveLockTimeout,
+		mysql.ErrRegionUnavailable:  mysql.ErrRegionUnavailable,
+		mysql.ErrGCTooEarly:         mysql.ErrGCTooEarly,
+	}
+	terror.ErrClassToMySQLCodes[terror.ClassTiKV] = tikvMySQLErrCodes
+}
+
 // TiDB decides whether to retry transaction by checking if error message contains
 // string "try again later" literally.
 // In TiClient we use `errors.Annotate(err, txnRetryableMark)` to direct TiDB to
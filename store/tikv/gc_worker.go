@@ -110,6 +110,9 @@ func (w *GCWorker) start() {
 	for {
 		select {
 		case <-ticker.C:
+			if err := w.loadSafePoint(); err != nil {
+				log.Warnf("[gc worker] load safe point err: %v", err)
+			}
 			isLeader, err := w.checkLeader()
 			if err != nil {
 				log.Warnf("[gc worker] check leader err: %v", err)
@@ -180,7 +183,20 @@ func (w *GCWorker) prepare() (bool, uint64, error) {
 	if err != nil {
 		return false, 0, errors.Trace(err)
 	}
-	return true, oracle.ComposeTS(oracle.GetPhysical(*newSafePoint), 0), nil
+	safePoint := oracle.ComposeTS(oracle.GetPhysical(*newSafePoint), 0)
+	w.store.updateSafePoint(safePoint)
+	return true, safePoint, nil
+}
+
+// loadSafePoint loads the safe point saved by the GC leader, which may be
+// another TiDB, into the store.
+func (w *GCWorker) loadSafePoint() error {
+	t, err := w.loadTime(gcSafePointKey)
+	if err != nil || t == nil {
+		return errors.Trace(err)
+	}
+	w.store.updateSafePoint(oracle.ComposeTS(oracle.GetPhysical(*t), 0))
+	return nil
 }
 
 func (w *GCWorker) getOracleTime() (time.Time, error) {
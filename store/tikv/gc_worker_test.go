@@ -17,7 +17,9 @@ import (
 	"math"
 	"time"
 
+	"github.com/juju/errors"
 	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
 )
 
 type testGCWorkerSuite struct {
@@ -100,3 +102,29 @@ func (s *testGCWorkerSuite) TestPrepareGC(c *C) {
 	c.Assert(err, IsNil)
 	s.timeEqual(c, safePoint.Add(time.Minute*30), now, time.Second)
 }
+
+func (s *testGCWorkerSuite) TestSafePoint(c *C) {
+	ver, err := s.store.CurrentVersion()
+	c.Assert(err, IsNil)
+	_, err = s.store.GetSnapshot(ver)
+	c.Assert(err, IsNil)
+
+	s.oracle.addOffset(gcDefaultLifeTime + time.Minute)
+	ok, safePoint, err := s.gcWorker.prepare()
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(safePoint, Greater, ver.Ver)
+	_, err = s.store.GetSnapshot(ver)
+	c.Assert(errors.Cause(err), Equals, ErrGCTooEarly)
+	_, err = s.store.GetSnapshot(kv.NewVersion(safePoint))
+	c.Assert(err, IsNil)
+
+	// The safe point saved by the leader is loaded, and never decreases.
+	s.store.safePoint = 0
+	c.Assert(s.gcWorker.loadSafePoint(), IsNil)
+	_, err = s.store.GetSnapshot(ver)
+	c.Assert(errors.Cause(err), Equals, ErrGCTooEarly)
+	s.store.updateSafePoint(ver.Ver)
+	_, err = s.store.GetSnapshot(ver)
+	c.Assert(errors.Cause(err), Equals, ErrGCTooEarly)
+}
@@ -17,8 +17,10 @@ import (
 	"fmt"
 	"math/rand"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
@@ -45,11 +47,12 @@ type Driver struct {
 
 // Open opens or creates an TiKV storage with given path.
 // Path example: tikv://etcd-node1:port,etcd-node2:port?cluster=1&disableGC=false
+// txnLocalLatches=N enables local latches with N slots, see latches.
 func (d Driver) Open(path string) (kv.Storage, error) {
 	mc.Lock()
 	defer mc.Unlock()
 
-	etcdAddrs, disableGC, err := parsePath(path)
+	etcdAddrs, disableGC, latchSlots, err := parsePath(path)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -72,6 +75,9 @@ func (d Driver) Open(path string) (kv.Storage, error) {
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	if latchSlots > 0 {
+		s.txnLatches = newLatches(latchSlots)
+	}
 	mc.cache[uuid] = s
 	return s, nil
 }
@@ -87,6 +93,11 @@ type tikvStore struct {
 	regionCache  *RegionCache
 	lockResolver *LockResolver
 	gcWorker     *GCWorker
+	// txnLatches is nil if local latches are disabled.
+	txnLatches *latches
+	// safePoint is the latest GC safe point known by GCWorker, accessed
+	// atomically.
+	safePoint uint64
 }
 
 func newTikvStore(uuid string, pdClient pd.Client, client Client, enableGC bool) (*tikvStore, error) {
@@ -133,11 +144,34 @@ func (s *tikvStore) Begin() (kv.Transaction, error) {
 }
 
 func (s *tikvStore) GetSnapshot(ver kv.Version) (kv.Snapshot, error) {
+	if err := s.checkVisibility(ver.Ver); err != nil {
+		return nil, errors.Trace(err)
+	}
 	snapshot := newTiKVSnapshot(s, ver)
 	snapshotCounter.Inc()
 	return snapshot, nil
 }
 
+// updateSafePoint records the GC safe point. It never decreases.
+func (s *tikvStore) updateSafePoint(safePoint uint64) {
+	for {
+		old := atomic.LoadUint64(&s.safePoint)
+		if safePoint <= old || atomic.CompareAndSwapUint64(&s.safePoint, old, safePoint) {
+			return
+		}
+	}
+}
+
+// checkVisibility returns ErrGCTooEarly if the versions at ts may have been
+// collected by GC. Only the safe point known by the GCWorker of this store is
+// checked, it's zero if GC is disabled.
+func (s *tikvStore) checkVisibility(ts uint64) error {
+	if safePoint := atomic.LoadUint64(&s.safePoint); ts < safePoint {
+		return errors.Annotatef(ErrGCTooEarly, "ts %d, safe point %d", ts, safePoint)
+	}
+	return nil
+}
+
 func (s *tikvStore) Close() error {
 	mc.Lock()
 	defer mc.Unlock()
@@ -187,10 +221,11 @@ func (s *tikvStore) GetClient() kv.Client {
 }
 
 func (s *tikvStore) SendKVReq(bo *Backoffer, req *pb.Request, regionID RegionVerID, timeout time.Duration) (*pb.Response, error) {
-	return sendKVReq(s.regionCache, s.client, bo, req, regionID, timeout)
+	sender := NewRegionRequestSender(bo, s.regionCache, s.client)
+	return sender.SendKVReq(req, regionID, timeout)
 }
 
-func parsePath(path string) (etcdAddrs []string, disableGC bool, err error) {
+func parsePath(path string) (etcdAddrs []string, disableGC bool, latchSlots int, err error) {
 	var u *url.URL
 	u, err = url.Parse(path)
 	if err != nil {
@@ -210,6 +245,13 @@ func parsePath(path string) (etcdAddrs []string, disableGC bool, err error) {
 		err = errors.New("disableGC flag should be true/false")
 		return
 	}
+	if v := u.Query().Get("txnLocalLatches"); v != "" {
+		latchSlots, err = strconv.Atoi(v)
+		if err != nil || latchSlots < 0 {
+			err = errors.New("txnLocalLatches should be a nonnegative number")
+			return
+		}
+	}
 	etcdAddrs = strings.Split(u.Host, ",")
 	return
 }
@@ -0,0 +1,144 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+)
+
+// latchRecordsLimit is the number of commit records a latch slot keeps before
+// it evicts the stale ones.
+const latchRecordsLimit = 256
+
+// latches serializes the commits of the transactions of this TiDB instance
+// that write overlapping keys, so they queue locally instead of conflicting
+// at prewrite and retrying. Keys are hashed into slots; a transaction holds
+// the slots of all its keys during 2PC, and acquires them in order so
+// transactions cannot deadlock.
+//
+// Each slot also records the commitTS of the keys committed through it. A
+// transaction that acquires a key committed after its startTS is bound to
+// fail at prewrite, so it fails at once instead. The records are only an
+// optimization: a dropped record leaves the conflict to be found by tikv.
+type latches struct {
+	slots []latchSlot
+}
+
+type latchSlot struct {
+	// mu is held by the transaction committing through the slot.
+	mu sync.Mutex
+	// records maps keys to the commitTS of the last transaction that
+	// committed them.
+	records map[string]uint64
+}
+
+// latchLock is the set of slots held by a transaction.
+type latchLock struct {
+	startTS uint64
+	keys    [][]byte
+	slots   []int
+}
+
+// newLatches creates latches with the given number of slots.
+func newLatches(size int) *latches {
+	if size < 1 {
+		size = 1
+	}
+	return &latches{slots: make([]latchSlot, size)}
+}
+
+func (l *latches) slotID(key []byte) int {
+	h := fnv.New64a()
+	h.Write(key)
+	return int(h.Sum64() % uint64(len(l.slots)))
+}
+
+// acquire blocks until the transaction holds the slots of keys. It returns a
+// retryable error if any of the keys is committed after startTS.
+func (l *latches) acquire(startTS uint64, keys [][]byte) (*latchLock, error) {
+	lock := &latchLock{startTS: startTS, keys: keys}
+	seen := make(map[int]struct{}, len(keys))
+	for _, key := range keys {
+		id := l.slotID(key)
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			lock.slots = append(lock.slots, id)
+		}
+	}
+	sort.Ints(lock.slots)
+
+	start := time.Now()
+	for _, id := range lock.slots {
+		l.slots[id].mu.Lock()
+	}
+	localLatchWaitHistogram.Observe(time.Since(start).Seconds())
+
+	for _, key := range keys {
+		if commitTS := l.slots[l.slotID(key)].records[string(key)]; commitTS > startTS {
+			l.release(lock, 0)
+			localLatchStaleCounter.Inc()
+			err := errors.Errorf("key %q is committed at %d after the txn starts at %d, by local latches", key, commitTS, startTS)
+			return nil, errors.Annotate(err, txnRetryableMark)
+		}
+	}
+	return lock, nil
+}
+
+// release releases the slots held by lock. A nonzero commitTS means the
+// transaction is committed, and is recorded for its keys.
+func (l *latches) release(lock *latchLock, commitTS uint64) {
+	if commitTS > 0 {
+		for _, key := range lock.keys {
+			slot := &l.slots[l.slotID(key)]
+			if slot.records == nil {
+				slot.records = make(map[string]uint64)
+			}
+			slot.records[string(key)] = commitTS
+		}
+		for _, id := range lock.slots {
+			l.slots[id].evict(commitTS)
+		}
+	}
+	for i := len(lock.slots) - 1; i >= 0; i-- {
+		l.slots[lock.slots[i]].mu.Unlock()
+	}
+}
+
+// evict drops the records no running transaction can conflict with once the
+// slot holds more than latchRecordsLimit records. Transactions that start
+// maxTxnTimeUse before commitTS can not commit anyway. If the slot is still
+// over the limit, arbitrary records are dropped until it's not.
+func (s *latchSlot) evict(commitTS uint64) {
+	if len(s.records) <= latchRecordsLimit {
+		return
+	}
+	expire := oracle.ExtractPhysical(commitTS) - maxTxnTimeUse
+	for key, ts := range s.records {
+		if oracle.ExtractPhysical(ts) < expire {
+			delete(s.records, key)
+		}
+	}
+	for key := range s.records {
+		if len(s.records) <= latchRecordsLimit {
+			break
+		}
+		delete(s.records, key)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+)
+
+var _ = Suite(&testLatchSuite{})
+
+type testLatchSuite struct{}
+
+func (s *testLatchSuite) TestWaitAndStale(c *C) {
+	l := newLatches(256)
+	keys := [][]byte{[]byte("a"), []byte("b")}
+	lock, err := l.acquire(1, keys)
+	c.Assert(err, IsNil)
+
+	// A txn writing "b" waits for the first txn.
+	acquired := make(chan error, 1)
+	go func() {
+		lock, err := l.acquire(2, [][]byte{[]byte("b"), []byte("c")})
+		if err == nil {
+			l.release(lock, 0)
+		}
+		acquired <- err
+	}()
+	select {
+	case <-acquired:
+		c.Fatal("acquired latches held by another txn")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The first txn commits after the second one starts.
+	l.release(lock, 3)
+	err = <-acquired
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), txnRetryableMark), IsTrue)
+
+	// Txns that start after the commit are not affected.
+	lock, err = l.acquire(4, [][]byte{[]byte("b")})
+	c.Assert(err, IsNil)
+	l.release(lock, 0)
+	lock, err = l.acquire(2, [][]byte{[]byte("c")})
+	c.Assert(err, IsNil)
+	l.release(lock, 0)
+}
+
+func (s *testLatchSuite) TestEvict(c *C) {
+	l := newLatches(1)
+	old := oracle.ComposeTS(oracle.GetPhysical(time.Now().Add(-time.Hour)), 0)
+	for i := 0; i < latchRecordsLimit; i++ {
+		lock, err := l.acquire(old-1, [][]byte{[]byte(fmt.Sprintf("old%d", i))})
+		c.Assert(err, IsNil)
+		l.release(lock, old)
+	}
+	c.Assert(l.slots[0].records, HasLen, latchRecordsLimit)
+
+	// Records older than maxTxnTimeUse are evicted once over the limit.
+	now := oracle.ComposeTS(oracle.GetPhysical(time.Now()), 0)
+	lock, err := l.acquire(now-1, [][]byte{[]byte("new")})
+	c.Assert(err, IsNil)
+	l.release(lock, now)
+	c.Assert(l.slots[0].records, HasLen, 1)
+	c.Assert(l.slots[0].records["new"], Equals, now)
+}
@@ -14,6 +14,11 @@
 package tikv
 
 import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -75,6 +80,71 @@ var (
 			Help:      "Bucketed histogram of sending request duration.",
 		}, []string{"type"})
 
+	sendReqCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "request_total",
+			Help:      "Counter of sent requests, estimated from samples.",
+		}, []string{"type"})
+
+	storeRequestHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "store_request_seconds",
+			Help:      "Bucketed histogram of sending request duration by command and store.",
+		}, []string{"type", "store"})
+
+	requestRetryHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "request_retries",
+			Help:      "Bucketed histogram of retries of requests sent by RegionRequestSender.",
+			Buckets:   []float64{0, 1, 2, 4, 8, 16, 32, 64},
+		})
+
+	regionCacheCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "region_cache_operations_total",
+			Help:      "Counter of region cache hits, misses, drops and evictions.",
+		}, []string{"type"})
+
+	regionReloadHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "region_reload_seconds",
+			Help:      "Bucketed histogram of loading region from PD duration.",
+		})
+
+	readCacheCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "read_cache_total",
+			Help:      "Counter of read cache hits and misses.",
+		}, []string{"type"})
+
+	copCacheCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "cop_cache_total",
+			Help:      "Counter of coprocessor cache hits, misses and admitted responses.",
+		}, []string{"type"})
+
+	storeLimiterCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "store_limiter_total",
+			Help:      "Counter of requests queued and rejected by store limiters, and limits decreased by ServerIsBusy.",
+		}, []string{"type"})
+
 	copBuildTaskHistogram = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Namespace: "tidb",
@@ -159,22 +229,81 @@ var (
 			Help:      "Size of kv pairs to write in a transaction. (KB)",
 			Buckets:   prometheus.ExponentialBuckets(1, 2, 21),
 		})
+
+	localLatchWaitHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "local_latch_wait_seconds",
+			Help:      "Bucketed histogram of time waiting for local latches before commit.",
+		})
+
+	localLatchStaleCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "tikvclient",
+			Name:      "local_latch_stale_total",
+			Help:      "Counter of transactions failed by local latches because of a newer commit.",
+		})
 )
 
+// metricsSampleRate holds the bits of the float64 sample rate of request
+// metrics, see SetMetricsSampleRate.
+var metricsSampleRate = math.Float64bits(1)
+
+// SetMetricsSampleRate sets the fraction of successful requests whose latency
+// is recorded. Failed requests are always recorded. The request counter is
+// scaled by the inverse of rate, so it keeps the approximate request rate,
+// while the count of the latency histogram only counts the sampled requests.
+// A rate out of (0, 1] means recording all requests.
+func SetMetricsSampleRate(rate float64) {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	atomic.StoreUint64(&metricsSampleRate, math.Float64bits(rate))
+}
+
+// requestSample tells whether a request should be recorded and the weight
+// of it.
+func requestSample(failed bool) (bool, float64) {
+	rate := math.Float64frombits(atomic.LoadUint64(&metricsSampleRate))
+	if failed || rate >= 1 {
+		return true, 1
+	}
+	if rand.Float64() >= rate {
+		return false, 0
+	}
+	return true, 1 / rate
+}
+
+// observeRequest records a request of kind tp, which is "kv" or "cop", and
+// command cmd sent to addr.
+func observeRequest(tp, cmd, addr string, start time.Time, failed bool) {
+	if ok, weight := requestSample(failed); ok {
+		d := time.Since(start).Seconds()
+		sendReqHistogram.WithLabelValues(tp).Observe(d)
+		sendReqCounter.WithLabelValues(tp).Add(weight)
+		storeRequestHistogram.WithLabelValues(cmd, addr).Observe(d)
+	}
+}
+
 func reportRegionError(e *errorpb.Error) {
+	regionErrorCounter.WithLabelValues(regionErrorLabel(e)).Inc()
+}
+
+func regionErrorLabel(e *errorpb.Error) string {
 	if e.GetNotLeader() != nil {
-		regionErrorCounter.WithLabelValues("not_leader").Inc()
+		return "not_leader"
 	} else if e.GetRegionNotFound() != nil {
-		regionErrorCounter.WithLabelValues("region_not_found").Inc()
+		return "region_not_found"
 	} else if e.GetKeyNotInRegion() != nil {
-		regionErrorCounter.WithLabelValues("key_not_in_region").Inc()
+		return "key_not_in_region"
 	} else if e.GetStaleEpoch() != nil {
-		regionErrorCounter.WithLabelValues("stale_epoch").Inc()
+		return "stale_epoch"
 	} else if e.GetServerIsBusy() != nil {
-		regionErrorCounter.WithLabelValues("server_is_busy").Inc()
-	} else {
-		regionErrorCounter.WithLabelValues("unknown").Inc()
+		return "server_is_busy"
 	}
+	return "unknown"
 }
 
 func init() {
@@ -185,6 +314,14 @@ func init() {
 	prometheus.MustRegister(backoffCounter)
 	prometheus.MustRegister(backoffHistogram)
 	prometheus.MustRegister(sendReqHistogram)
+	prometheus.MustRegister(sendReqCounter)
+	prometheus.MustRegister(storeRequestHistogram)
+	prometheus.MustRegister(requestRetryHistogram)
+	prometheus.MustRegister(regionCacheCounter)
+	prometheus.MustRegister(regionReloadHistogram)
+	prometheus.MustRegister(readCacheCounter)
+	prometheus.MustRegister(copCacheCounter)
+	prometheus.MustRegister(storeLimiterCounter)
 	prometheus.MustRegister(copBuildTaskHistogram)
 	prometheus.MustRegister(copTaskLenHistogram)
 	prometheus.MustRegister(coprocessorCounter)
@@ -195,4 +332,6 @@ func init() {
 	prometheus.MustRegister(regionErrorCounter)
 	prometheus.MustRegister(txnWriteKVCountHistogram)
 	prometheus.MustRegister(txnWriteSizeHistogram)
+	prometheus.MustRegister(localLatchWaitHistogram)
+	prometheus.MustRegister(localLatchStaleCounter)
 }
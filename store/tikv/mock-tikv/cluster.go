@@ -112,6 +112,26 @@ func (c *Cluster) RemoveStore(storeID uint64) {
 	delete(c.stores, storeID)
 }
 
+// UpdateStoreAddr updates the address of a Store.
+func (c *Cluster) UpdateStoreAddr(storeID uint64, addr string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if store := c.stores[storeID]; store != nil {
+		store.meta.Address = addr
+	}
+}
+
+// MarkTombstone marks a Store as tombstone.
+func (c *Cluster) MarkTombstone(storeID uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if store := c.stores[storeID]; store != nil {
+		store.meta.State = metapb.StoreState_Tombstone
+	}
+}
+
 // GetRegion returns a Region's meta and leader ID.
 func (c *Cluster) GetRegion(regionID uint64) (*metapb.Region, uint64) {
 	c.RLock()
@@ -23,6 +23,7 @@ import (
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/tidb/util/codec"
+	"golang.org/x/net/context"
 )
 
 type rpcHandler struct {
@@ -333,7 +334,10 @@ type RPCClient struct {
 }
 
 // SendKVReq sends a kv request to mock cluster.
-func (c *RPCClient) SendKVReq(addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+func (c *RPCClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
 	store := c.cluster.GetStoreByAddr(addr)
 	if store == nil {
 		return nil, errors.New("connect fail")
@@ -343,7 +347,10 @@ func (c *RPCClient) SendKVReq(addr string, req *kvrpcpb.Request, timeout time.Du
 }
 
 // SendCopReq sends a coprocessor request to mock cluster.
-func (c *RPCClient) SendCopReq(addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error) {
+func (c *RPCClient) SendCopReq(ctx context.Context, addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
 	store := c.cluster.GetStoreByAddr(addr)
 	if store == nil {
 		return nil, errors.New("connect fail")
@@ -352,6 +359,9 @@ func (c *RPCClient) SendCopReq(addr string, req *coprocessor.Request, timeout ti
 	return handler.handleCopRequest(req)
 }
 
+// RecycleConn does nothing, since RPCClient has no connection.
+func (c *RPCClient) RecycleConn(addr string) {}
+
 // Close closes the client.
 func (c *RPCClient) Close() error {
 	return nil
@@ -0,0 +1,165 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocktikv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"golang.org/x/net/context"
+)
+
+// ScriptStep is the scripted result of one request sent to a region by
+// ScriptedClient.
+type ScriptStep struct {
+	// Delay is how long the request takes. If it's longer than the timeout
+	// of the request, the request fails with ErrScriptedTimeout after the
+	// timeout.
+	Delay time.Duration
+	// SendErr makes the request fail to send.
+	SendErr error
+	// RegionError is returned in the response instead of sending the
+	// request.
+	RegionError *errorpb.Error
+}
+
+// ErrScriptedTimeout is returned by ScriptedClient when a request times out.
+var ErrScriptedTimeout = errors.New("scripted timeout")
+
+// ScriptedClient is an RPCClient for tests of retry logic. It plays scripted
+// steps for the requests sent to each region, in order, and passes requests
+// to the wrapped RPCClient once the script of the region is used up. A step
+// with neither SendErr nor RegionError passes the request through after its
+// Delay.
+type ScriptedClient struct {
+	*RPCClient
+	mu      sync.Mutex
+	scripts map[uint64][]ScriptStep
+}
+
+// NewScriptedClient creates a ScriptedClient that wraps client.
+func NewScriptedClient(client *RPCClient) *ScriptedClient {
+	return &ScriptedClient{
+		RPCClient: client,
+		scripts:   make(map[uint64][]ScriptStep),
+	}
+}
+
+// Script appends steps to the script of the region.
+func (c *ScriptedClient) Script(regionID uint64, steps ...ScriptStep) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scripts[regionID] = append(c.scripts[regionID], steps...)
+}
+
+// Pending returns the number of steps of the region that have not been
+// played.
+func (c *ScriptedClient) Pending(regionID uint64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.scripts[regionID])
+}
+
+func (c *ScriptedClient) nextStep(regionID uint64) (ScriptStep, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	steps := c.scripts[regionID]
+	if len(steps) == 0 {
+		return ScriptStep{}, false
+	}
+	c.scripts[regionID] = steps[1:]
+	return steps[0], true
+}
+
+// play plays the next step of the region. It returns the error or region
+// error of the step, and whether the request should be passed through.
+func (c *ScriptedClient) play(ctx context.Context, regionID uint64, timeout time.Duration) (*errorpb.Error, bool, error) {
+	step, ok := c.nextStep(regionID)
+	if !ok {
+		return nil, true, nil
+	}
+	if step.Delay > 0 {
+		d := step.Delay
+		if timeout > 0 && timeout < d {
+			d = timeout
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return nil, false, errors.Trace(ctx.Err())
+		}
+		if d < step.Delay {
+			return nil, false, errors.Trace(ErrScriptedTimeout)
+		}
+	}
+	if step.SendErr != nil {
+		return nil, false, errors.Trace(step.SendErr)
+	}
+	if step.RegionError != nil {
+		return step.RegionError, false, nil
+	}
+	return nil, true, nil
+}
+
+// SendKVReq plays the next step of the region, or sends the kv request to
+// mock cluster.
+func (c *ScriptedClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	regionErr, pass, err := c.play(ctx, req.GetContext().GetRegionId(), timeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !pass {
+		return &kvrpcpb.Response{Type: req.GetType(), RegionError: regionErr}, nil
+	}
+	return c.RPCClient.SendKVReq(ctx, addr, req, timeout)
+}
+
+// SendCopReq plays the next step of the region, or sends the coprocessor
+// request to mock cluster.
+func (c *ScriptedClient) SendCopReq(ctx context.Context, addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error) {
+	regionErr, pass, err := c.play(ctx, req.GetContext().GetRegionId(), timeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !pass {
+		return &coprocessor.Response{RegionError: regionErr}, nil
+	}
+	return c.RPCClient.SendCopReq(ctx, addr, req, timeout)
+}
+
+// NotLeaderStep returns a step of `NotLeader`. A nil leader means tikv does
+// not know the new leader.
+func NotLeaderStep(regionID uint64, leader *metapb.Peer) ScriptStep {
+	return ScriptStep{RegionError: &errorpb.Error{
+		NotLeader: &errorpb.NotLeader{RegionId: proto.Uint64(regionID), Leader: leader},
+	}}
+}
+
+// StaleEpochStep returns a step of `StaleEpoch` carrying the new regions.
+func StaleEpochStep(newRegions ...*metapb.Region) ScriptStep {
+	return ScriptStep{RegionError: &errorpb.Error{
+		StaleEpoch: &errorpb.StaleEpoch{NewRegions: newRegions},
+	}}
+}
+
+// ServerIsBusyStep returns a step of `ServerIsBusy`.
+func ServerIsBusyStep() ScriptStep {
+	return ScriptStep{RegionError: &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}}
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+// PeerSelector picks the peer to try when the current peer of a region fails,
+// see RegionCache.NextPeer.
+type PeerSelector interface {
+	// SelectPeer returns the index of the peer to try next among candidates,
+	// which are the peers not tried yet in their order in the region.
+	// stores are the stores of candidates, an element is nil if the store
+	// failed to load. An index out of range is taken as 0.
+	SelectPeer(candidates []*metapb.Peer, stores []*metapb.Store) int
+}
+
+// RoundRobinPeerSelector tries peers in their order in the region. It's the
+// default PeerSelector.
+type RoundRobinPeerSelector struct{}
+
+// SelectPeer implements PeerSelector interface.
+func (RoundRobinPeerSelector) SelectPeer(candidates []*metapb.Peer, stores []*metapb.Store) int {
+	return 0
+}
+
+// TagPeerSelector tries peers on stores with Tag first, e.g. the stores in the
+// local zone. Tags are compared case insensitively. Other peers are tried in
+// their order in the region.
+type TagPeerSelector struct {
+	Tag string
+}
+
+// SelectPeer implements PeerSelector interface.
+func (s TagPeerSelector) SelectPeer(candidates []*metapb.Peer, stores []*metapb.Store) int {
+	for i, store := range stores {
+		for _, tag := range store.GetTags() {
+			if strings.EqualFold(tag, s.Tag) {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+type peerSelectorHolder struct {
+	selector PeerSelector
+}
+
+// SetPeerSelector sets the PeerSelector used by NextPeer. Nil means
+// RoundRobinPeerSelector.
+func (c *RegionCache) SetPeerSelector(s PeerSelector) {
+	c.peerSelector.Store(peerSelectorHolder{selector: s})
+}
+
+func (c *RegionCache) getPeerSelector() PeerSelector {
+	h, _ := c.peerSelector.Load().(peerSelectorHolder)
+	return h.selector
+}
+
+// loadStore loads the store from PD, and caches it for PeerSelector.
+func (c *RegionCache) loadStore(storeID uint64) (*metapb.Store, error) {
+	store, err := c.pdClient.GetStore(storeID)
+	if err != nil {
+		return nil, err
+	}
+	c.stores.Lock()
+	c.stores.m[storeID] = store
+	c.stores.Unlock()
+	return store, nil
+}
+
+// getStore returns the cached store, or loads it from PD. It returns nil if
+// the store failed to load.
+func (c *RegionCache) getStore(storeID uint64) *metapb.Store {
+	c.stores.RLock()
+	store, ok := c.stores.m[storeID]
+	c.stores.RUnlock()
+	if ok {
+		return store
+	}
+	store, err := c.loadStore(storeID)
+	if err != nil {
+		log.Warnf("regionCache: failed load store %d: %v", storeID, err)
+		return nil
+	}
+	return store
+}
+
+// nextPeerBySelector switches the cached region to the peer picked by sel.
+// The picked peer is moved right after the current peer, so the peers that
+// are skipped are still tried later. The region is dropped if all its peers
+// are tried.
+func (c *RegionCache) nextPeerBySelector(id RegionVerID, sel PeerSelector) {
+	region := c.GetRegionByVerID(id)
+	if region == nil {
+		return
+	}
+	next := region.curPeerIdx + 1
+	if next >= len(region.meta.Peers) {
+		c.DropRegion(id)
+		return
+	}
+	candidates := region.meta.Peers[next:]
+	stores := make([]*metapb.Store, len(candidates))
+	for i, p := range candidates {
+		stores[i] = c.getStore(p.GetStoreId())
+	}
+	i := sel.SelectPeer(candidates, stores)
+	if i < 0 || i >= len(candidates) {
+		i = 0
+	}
+
+	picked := candidates[i].GetId()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.mu.regions[id]
+	if !ok || r.curPeerIdx+1 != next {
+		// The region is switched by other requests meanwhile.
+		return
+	}
+	for j := next; j < len(r.meta.Peers); j++ {
+		if r.meta.Peers[j].GetId() == picked {
+			r.meta.Peers[next], r.meta.Peers[j] = r.meta.Peers[j], r.meta.Peers[next]
+			c.switchPeer(r, next)
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// ResponseProcessor transforms or inspects a successful KV response before it
+// is returned to caller. It may return a different response, or an error to
+// fail the request.
+type ResponseProcessor func(req *kvrpcpb.Request, resp *kvrpcpb.Response) (*kvrpcpb.Response, error)
+
+func (s *RegionRequestSender) processResponse(req *kvrpcpb.Request, resp *kvrpcpb.Response) (*kvrpcpb.Response, error) {
+	for _, p := range s.ResponseProcessors {
+		var err error
+		resp, err = p(req, resp)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/tidb/kv"
+	"golang.org/x/net/context"
+)
+
+// rangeTaskMaxResplits is the max number of times the range of a Region is
+// split again after the Region changes while the handler runs on it.
+const rangeTaskMaxResplits = 3
+
+// RangeTaskHandler runs a range task on a range that lies in one Region.
+type RangeTaskHandler func(ctx context.Context, r kv.KeyRange) error
+
+// RangeTaskFailure is a range that a RangeTaskHandler failed to run on.
+type RangeTaskFailure struct {
+	Range kv.KeyRange
+	Err   error
+}
+
+// RangeTaskStat is the result of RangeTaskRunner.RunOnRange.
+type RangeTaskStat struct {
+	// CompletedRegions is the number of ranges the handler succeeded on.
+	CompletedRegions int
+	// Failures are the ranges the handler failed on, in no particular order.
+	Failures []RangeTaskFailure
+}
+
+// RangeTaskRunner splits a range of keys by Regions, and runs a handler on
+// each part with bounded concurrency. It's for background jobs that go over
+// the whole key space, like resolving locks before GC.
+//
+// If the handler fails after the Region of a part is changed in cache, e.g.
+// by `StaleEpoch` of a request sent by the handler, the part is split by the
+// new Regions and run again. Other failures are reported by RunOnRange, and
+// don't stop the other parts.
+type RangeTaskRunner struct {
+	name        string
+	cache       *RegionCache
+	concurrency int
+	handler     RangeTaskHandler
+	// completed is the number of parts completed by the running RunOnRange,
+	// accessed atomically.
+	completed int64
+}
+
+type rangeTask struct {
+	region RegionVerID
+	r      kv.KeyRange
+}
+
+// NewRangeTaskRunner creates a RangeTaskRunner. The name is used in logs.
+func NewRangeTaskRunner(name string, cache *RegionCache, concurrency int, handler RangeTaskHandler) *RangeTaskRunner {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &RangeTaskRunner{
+		name:        name,
+		cache:       cache,
+		concurrency: concurrency,
+		handler:     handler,
+	}
+}
+
+// CompletedRegions returns the number of parts completed by the running
+// RunOnRange, for reporting progress.
+func (r *RangeTaskRunner) CompletedRegions() int {
+	return int(atomic.LoadInt64(&r.completed))
+}
+
+// RunOnRange runs the handler on [startKey, endKey), an empty endKey means the
+// end of the key space. It returns an error only if ctx is done or a Region
+// fails to load, failures of the handler are in the stat.
+func (r *RangeTaskRunner) RunOnRange(ctx context.Context, startKey, endKey []byte) (RangeTaskStat, error) {
+	atomic.StoreInt64(&r.completed, 0)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		stat     RangeTaskStat
+		firstErr error
+	)
+	ch := make(chan rangeTask)
+	for i := 0; i < r.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				failures, err := r.run(ctx, t, 0)
+				mu.Lock()
+				stat.Failures = append(stat.Failures, failures...)
+				if err != nil && firstErr == nil {
+					firstErr = errors.Trace(err)
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	key := startKey
+SendLoop:
+	for {
+		// Each lookup has its own backoff budget, a run over the whole key
+		// space may back off many times in total.
+		region, err := r.cache.GetRegion(NewBackoffer(warmUpMaxBackoff, ctx), key)
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = errors.Trace(err)
+			}
+			mu.Unlock()
+			break
+		}
+		t := rangeTask{region: region.VerID(), r: clipRange(key, endKey, region)}
+		select {
+		case ch <- t:
+		case <-ctx.Done():
+			break SendLoop
+		}
+		key = region.EndKey()
+		if len(key) == 0 || (len(endKey) > 0 && bytes.Compare(key, endKey) >= 0) {
+			break
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	stat.CompletedRegions = r.CompletedRegions()
+	if firstErr != nil {
+		return stat, firstErr
+	}
+	return stat, errors.Trace(ctx.Err())
+}
+
+// run runs the handler on t, and splits t again if its Region is changed in
+// cache after the handler fails. The Region lookups of one split share a
+// backoff budget.
+func (r *RangeTaskRunner) run(ctx context.Context, t rangeTask, resplits int) ([]RangeTaskFailure, error) {
+	err := r.handler(ctx, t.r)
+	if err == nil {
+		atomic.AddInt64(&r.completed, 1)
+		return nil, nil
+	}
+	if ctx.Err() != nil {
+		return nil, errors.Trace(ctx.Err())
+	}
+	if resplits >= rangeTaskMaxResplits || r.cache.regionCached(t.region) {
+		log.Warnf("range task %s: failed on [%q, %q): %v", r.name, t.r.StartKey, t.r.EndKey, err)
+		return []RangeTaskFailure{{Range: t.r, Err: err}}, nil
+	}
+
+	var failures []RangeTaskFailure
+	bo := NewBackoffer(warmUpMaxBackoff, ctx)
+	key := []byte(t.r.StartKey)
+	for {
+		region, err := r.cache.GetRegion(bo, key)
+		if err != nil {
+			return failures, errors.Trace(err)
+		}
+		sub := rangeTask{region: region.VerID(), r: clipRange(key, t.r.EndKey, region)}
+		fs, err := r.run(ctx, sub, resplits+1)
+		failures = append(failures, fs...)
+		if err != nil {
+			return failures, errors.Trace(err)
+		}
+		key = region.EndKey()
+		if len(key) == 0 || (len(t.r.EndKey) > 0 && bytes.Compare(key, t.r.EndKey) >= 0) {
+			return failures, nil
+		}
+	}
+}
+
+// clipRange returns the part of [startKey, endKey) in region, startKey must be
+// in region.
+func clipRange(startKey, endKey []byte, region *Region) kv.KeyRange {
+	end := region.EndKey()
+	if len(end) == 0 || (len(endKey) > 0 && bytes.Compare(endKey, end) < 0) {
+		end = endKey
+	}
+	return kv.KeyRange{StartKey: startKey, EndKey: end}
+}
+
+// regionCached returns whether the Region is still in cache.
+func (c *RegionCache) regionCached(id RegionVerID) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.mu.regions[id]
+	return ok
+}
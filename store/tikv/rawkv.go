@@ -14,12 +14,18 @@
 package tikv
 
 import (
+	"sync"
+
 	"github.com/juju/errors"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/pd/pd-client"
 	"golang.org/x/net/context"
 )
 
+// rawBatchConcurrency is the max number of requests sent at the same time by
+// RawKVClient.BatchGet and RawKVClient.BatchPut.
+const rawBatchConcurrency = 16
+
 // RawKVClient is a client of TiKV server which is used as a key-value storage,
 // only GET/PUT/DELETE commands are supported.
 type RawKVClient struct {
@@ -114,14 +120,87 @@ func (c *RawKVClient) Delete(key []byte) error {
 	return nil
 }
 
+// BatchGet queries values of keys. Keys that do not exist are not in the
+// returned map. TiKV has no raw batch command, so it sends one Get for each
+// key, at most rawBatchConcurrency at a time.
+func (c *RawKVClient) BatchGet(keys [][]byte) (map[string][]byte, error) {
+	var mu sync.Mutex
+	values := make(map[string][]byte, len(keys))
+	err := c.doBatch(len(keys), func(i int) error {
+		v, err := c.Get(keys[i])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if v != nil {
+			mu.Lock()
+			values[string(keys[i])] = v
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return values, nil
+}
+
+// BatchPut stores key-value pairs to TiKV, in the same way as BatchGet. It's
+// not atomic: if an error is returned, some of the pairs may be stored.
+func (c *RawKVClient) BatchPut(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.Errorf("the number of keys %d and values %d mismatch", len(keys), len(values))
+	}
+	return c.doBatch(len(keys), func(i int) error {
+		return errors.Trace(c.Put(keys[i], values[i]))
+	})
+}
+
+// doBatch calls f for 0 to n-1 concurrently, and returns the first error. No
+// call starts after an error.
+func (c *RawKVClient) doBatch(n int, f func(i int) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, rawBatchConcurrency)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := f(i); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errors.Trace(firstErr)
+}
+
 func (c *RawKVClient) sendKVReq(key []byte, req *kvrpcpb.Request) (*kvrpcpb.Response, error) {
 	bo := NewBackoffer(rawkvMaxBackoff, context.Background())
+	sender := NewRegionRequestSender(bo, c.regionCache, c.rpcClient)
 	for {
 		region, err := c.regionCache.GetRegion(bo, key)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
-		resp, err := sendKVReq(c.regionCache, c.rpcClient, bo, req, region.VerID(), readTimeoutShort)
+		resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -87,3 +87,22 @@ func (s *testRawKVSuite) TestSplit(c *C) {
 	s.mustGet(c, []byte("k1"), []byte("v1"))
 	s.mustGet(c, []byte("k3"), []byte("v3"))
 }
+
+func (s *testRawKVSuite) TestBatch(c *C) {
+	region1, err := s.client.regionCache.GetRegion(s.bo, []byte("k"))
+	c.Assert(err, IsNil)
+	newRegionID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.Split(region1.GetID(), newRegionID, []byte("k2"), []uint64{peerID}, peerID)
+
+	keys := [][]byte{[]byte("k1"), []byte("k2"), []byte("k3")}
+	err = s.client.BatchPut(keys, [][]byte{[]byte("v1"), []byte("v2"), []byte("")})
+	c.Assert(err, IsNil)
+	s.mustGet(c, []byte("k2"), []byte("v2"))
+
+	values, err := s.client.BatchGet(append(keys, []byte("k4")))
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, map[string][]byte{"k1": []byte("v1"), "k2": []byte("v2"), "k3": []byte("")})
+
+	err = s.client.BatchPut(keys, nil)
+	c.Assert(err, NotNil)
+}
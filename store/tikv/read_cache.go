@@ -0,0 +1,160 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// readCache caches the responses of point reads, see SenderConfig.ReadCacheTTL.
+// An entry is used only if the region's epoch is unchanged, so a split or
+// merge invalidates the entries of the region. Transactional reads are cached
+// by version, their results never change once they are read without meeting
+// a lock. Raw reads are cached by key only, so a write by other clients may be
+// missed until the entry expires.
+type readCache struct {
+	sync.Mutex
+	// entries are keyed by the read key, then by the region and version.
+	entries map[string]map[readCacheKey]*readCacheEntry
+	// fifo holds the readCacheRef of entries in the order they are added.
+	fifo *list.List
+	// gens are the generations of regions, keyed by region ID. Bumping it
+	// invalidates the cached entries of the region.
+	gens map[uint64]uint64
+}
+
+type readCacheKey struct {
+	region  RegionVerID
+	tp      kvrpcpb.MessageType
+	version uint64
+}
+
+type readCacheRef struct {
+	key string
+	ck  readCacheKey
+}
+
+type readCacheEntry struct {
+	resp   *kvrpcpb.Response
+	expire time.Time
+	gen    uint64
+	elem   *list.Element
+}
+
+// cacheableRead returns the key and version of a point read whose response can
+// be cached.
+func cacheableRead(req *kvrpcpb.Request) (key []byte, version uint64, ok bool) {
+	switch req.GetType() {
+	case kvrpcpb.MessageType_CmdGet:
+		return req.GetCmdGetReq().GetKey(), req.GetCmdGetReq().GetVersion(), true
+	case kvrpcpb.MessageType_CmdRawGet:
+		return req.GetCmdRawGetReq().GetKey(), 0, true
+	}
+	return nil, 0, false
+}
+
+// get returns a copy of the cached response of req sent to region.
+func (c *readCache) get(region RegionVerID, req *kvrpcpb.Request) (*kvrpcpb.Response, bool) {
+	key, version, ok := cacheableRead(req)
+	if !ok {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	ck := readCacheKey{region: region, tp: req.GetType(), version: version}
+	e, ok := c.entries[string(key)][ck]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expire) || e.gen != c.gens[region.id] {
+		c.remove(string(key), ck, e)
+		return nil, false
+	}
+	return proto.Clone(e.resp).(*kvrpcpb.Response), true
+}
+
+// put caches resp of req if it's a successful point read. The oldest entries
+// are evicted if there are more than size entries.
+func (c *readCache) put(region RegionVerID, req *kvrpcpb.Request, resp *kvrpcpb.Response, ttl time.Duration, size int) {
+	key, version, ok := cacheableRead(req)
+	if !ok {
+		return
+	}
+	if resp.GetCmdGetResp().GetError() != nil || resp.GetCmdRawGetResp().GetError() != "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]map[readCacheKey]*readCacheEntry)
+		c.fifo = list.New()
+		c.gens = make(map[uint64]uint64)
+	}
+	ck := readCacheKey{region: region, tp: req.GetType(), version: version}
+	m, ok := c.entries[string(key)]
+	if !ok {
+		m = make(map[readCacheKey]*readCacheEntry)
+		c.entries[string(key)] = m
+	}
+	if old, ok := m[ck]; ok {
+		c.fifo.Remove(old.elem)
+	}
+	m[ck] = &readCacheEntry{
+		resp:   proto.Clone(resp).(*kvrpcpb.Response),
+		expire: time.Now().Add(ttl),
+		gen:    c.gens[region.id],
+		elem:   c.fifo.PushBack(readCacheRef{key: string(key), ck: ck}),
+	}
+	for c.fifo.Len() > size {
+		ref := c.fifo.Front().Value.(readCacheRef)
+		c.remove(ref.key, ref.ck, c.entries[ref.key][ref.ck])
+	}
+}
+
+// invalidateKeys removes the cached reads of keys.
+func (c *readCache) invalidateKeys(keys [][]byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, k := range keys {
+		for ck, e := range c.entries[string(k)] {
+			c.remove(string(k), ck, e)
+		}
+	}
+}
+
+// invalidateRegion invalidates the cached reads of the region.
+func (c *readCache) invalidateRegion(regionID uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.gens != nil {
+		c.gens[regionID]++
+	}
+}
+
+func (c *readCache) remove(key string, ck readCacheKey, e *readCacheEntry) {
+	c.fifo.Remove(e.elem)
+	delete(c.entries[key], ck)
+	if len(c.entries[key]) == 0 {
+		delete(c.entries, key)
+	}
+}
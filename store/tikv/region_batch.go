@@ -0,0 +1,90 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// batchSendConcurrency is the max number of regions SendBatchKVReq sends to at
+// a time.
+const batchSendConcurrency = 16
+
+// SendBatchKVReq sends the requests to their regions concurrently. Each one is
+// sent in the same way as SendKVReq, with the options of the sender and a
+// fork of its Backoffer, so region errors are handled and retried per region.
+// A failure in one region does not stop the others, but none is sent after the
+// context of the Backoffer is done.
+//
+// It returns the responses of the regions that have not failed, including the
+// ones with region errors that must be handled by caller, e.g. `StaleEpoch`,
+// and the first error. The results of the sender, e.g. Meta, are not updated.
+func (s *RegionRequestSender) SendBatchKVReq(reqs map[RegionVerID]*kvrpcpb.Request, timeout time.Duration) (map[RegionVerID]*kvrpcpb.Response, error) {
+	type task struct {
+		regionID RegionVerID
+		req      *kvrpcpb.Request
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		resps    = make(map[RegionVerID]*kvrpcpb.Response, len(reqs))
+		firstErr error
+	)
+	concurrency := batchSendConcurrency
+	if concurrency > len(reqs) {
+		concurrency = len(reqs)
+	}
+	ch := make(chan task)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				sender := *s
+				sender.bo = s.bo.Fork()
+				resp, err := sender.SendKVReq(t.req, t.regionID, timeout)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = errors.Trace(err)
+					}
+				} else {
+					resps[t.regionID] = resp
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+SendLoop:
+	for regionID, req := range reqs {
+		select {
+		case ch <- task{regionID: regionID, req: req}:
+		case <-s.bo.ctx.Done():
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = errors.Trace(s.bo.ctx.Err())
+			}
+			mu.Unlock()
+			break SendLoop
+		}
+	}
+	close(ch)
+	wg.Wait()
+	return resps, firstErr
+}
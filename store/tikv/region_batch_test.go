@@ -0,0 +1,84 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"golang.org/x/net/context"
+)
+
+// failRegionClient fails to send the requests to a region.
+type failRegionClient struct {
+	Client
+	regionID uint64
+}
+
+func (c *failRegionClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	if req.GetContext().GetRegionId() == c.regionID {
+		return nil, errors.New("send fail")
+	}
+	return c.Client.SendKVReq(ctx, addr, req, timeout)
+}
+
+func (s *testRegionRequestSuite) TestSendBatchKVReq(c *C) {
+	// ['' - 'b' - 'c' - '']
+	peers := s.cluster.AllocIDs(2)
+	regionB, regionC := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.Split(s.region, regionB, []byte("b"), []uint64{peers[0]}, peers[0])
+	s.cluster.Split(regionB, regionC, []byte("c"), []uint64{peers[1]}, peers[1])
+
+	reqs := make(map[RegionVerID]*kvrpcpb.Request)
+	keys := make(map[RegionVerID]string)
+	for _, key := range []string{"a", "b", "c"} {
+		region, err := s.cache.GetRegion(s.bo, []byte(key))
+		c.Assert(err, IsNil)
+		reqs[region.VerID()] = &kvrpcpb.Request{
+			Type:         kvrpcpb.MessageType_CmdRawPut,
+			CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{Key: []byte(key), Value: []byte(key)},
+		}
+		keys[region.VerID()] = key
+	}
+	resps, err := s.newSender().SendBatchKVReq(reqs, readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resps, HasLen, 3)
+	for id, resp := range resps {
+		c.Assert(resp.GetRegionError(), IsNil)
+		c.Assert(resp.GetCmdRawPutResp().GetError(), Equals, "", Commentf("region %v", id))
+	}
+
+	// A failed region does not stop the others, it bounces back to caller
+	// with StaleEpoch after it is dropped from the cache.
+	client := &failRegionClient{Client: s.client, regionID: regionB}
+	resps, err = NewRegionRequestSender(NewBackoffer(100, context.Background()), s.cache, client).SendBatchKVReq(reqs, readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resps, HasLen, 3)
+	for id, resp := range resps {
+		if keys[id] == "b" {
+			c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+		} else {
+			c.Assert(resp.GetRegionError(), IsNil)
+		}
+	}
+
+	// Nothing is sent after the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resps, err = NewRegionRequestSender(NewBackoffer(100, ctx), s.cache, client).SendBatchKVReq(reqs, readTimeoutShort)
+	c.Assert(err, NotNil)
+	c.Assert(len(resps) < 3, IsTrue)
+}
@@ -16,6 +16,8 @@ package tikv
 import (
 	"bytes"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/juju/errors"
@@ -29,13 +31,55 @@ import (
 // RegionCache caches Regions loaded from PD.
 type RegionCache struct {
 	pdClient pd.Client
-	mu       struct {
+	// reloadTimeout is the time.Duration of the timeout of loading a Region
+	// from PD, see SetReloadTimeout.
+	reloadTimeout int64
+	// sendFails counts consecutive send failures of addresses.
+	sendFails struct {
+		sync.RWMutex
+		m map[string]int
+	}
+	// health tracks reachability of stores, see StoreReachable.
+	health storeHealthMap
+	// breakers are the circuit breakers of stores, keyed by store ID.
+	breakers circuitBreakerMap
+	// reads caches responses of point reads, see SenderConfig.ReadCacheTTL.
+	reads readCache
+	// cops caches coprocessor responses, see SenderConfig.CopCacheCapacity.
+	cops copCache
+	// limiters limit the requests in flight to stores, see
+	// SenderConfig.StoreMaxInflight.
+	limiters storeLimiterMap
+	// errHistory records the region errors returned to the senders, see
+	// SetRegionErrorHistorySize.
+	errHistory regionErrorHistory
+	// senderCfg holds the SenderConfig of the senders of the cache, see
+	// RegionCache.ReconfigureSender.
+	senderCfg atomic.Value
+	// peerSelector holds the PeerSelector, see SetPeerSelector.
+	peerSelector atomic.Value
+	// stores caches the stores loaded from PD for PeerSelector.
+	stores struct {
+		sync.RWMutex
+		m map[uint64]*metapb.Store
+	}
+	mu struct {
 		sync.RWMutex
 		regions map[RegionVerID]*Region
 		sorted  *llrb.LLRB
+		// sizes are approximate sizes of regions, keyed by region ID.
+		sizes map[uint64]regionSize
+		// notLeaderAt is the time of the last dampened `NotLeader` of
+		// regions, see DampenNotLeader.
+		notLeaderAt map[RegionVerID]time.Time
 	}
 }
 
+type regionSize struct {
+	size uint64
+	keys uint64
+}
+
 // NewRegionCache creates a RegionCache.
 func NewRegionCache(pdClient pd.Client) *RegionCache {
 	c := &RegionCache{
@@ -43,6 +87,13 @@ func NewRegionCache(pdClient pd.Client) *RegionCache {
 	}
 	c.mu.regions = make(map[RegionVerID]*Region)
 	c.mu.sorted = llrb.New()
+	c.mu.sizes = make(map[uint64]regionSize)
+	c.mu.notLeaderAt = make(map[RegionVerID]time.Time)
+	c.sendFails.m = make(map[string]int)
+	c.health.m = make(map[uint64]*storeHealth)
+	c.stores.m = make(map[uint64]*metapb.Store)
+	c.breakers.m = make(map[uint64]*circuitBreaker)
+	c.limiters.m = make(map[uint64]*storeLimiter)
 	return c
 }
 
@@ -59,19 +110,28 @@ func (c *RegionCache) GetRegionByVerID(id RegionVerID) *Region {
 
 // GetRegion find in cache, or get new region.
 func (c *RegionCache) GetRegion(bo *Backoffer, key []byte) (*Region, error) {
+	r, _, err := c.getRegion(bo, key)
+	return r, errors.Trace(err)
+}
+
+// getRegion is like GetRegion, and it also tells whether the region is loaded
+// from PD.
+func (c *RegionCache) getRegion(bo *Backoffer, key []byte) (r *Region, loaded bool, err error) {
 	c.mu.RLock()
-	r := c.getRegionFromCache(key)
+	r = c.getRegionFromCache(key)
 	c.mu.RUnlock()
 	if r != nil {
-		return r, nil
+		regionCacheCounter.WithLabelValues("hit").Inc()
+		return r, false, nil
 	}
-	r, err := c.loadRegion(bo, key)
+	regionCacheCounter.WithLabelValues("miss").Inc()
+	r, err = c.loadRegion(bo, key)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, true, errors.Trace(err)
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.insertRegionToCache(r), nil
+	return c.insertRegionToCache(r), true, nil
 }
 
 // GroupKeysByRegion separates keys into groups by their belonging Regions.
@@ -102,6 +162,55 @@ func (c *RegionCache) GroupKeysByRegion(bo *Backoffer, keys [][]byte) (map[Regio
 	return groups, first, nil
 }
 
+// UpdateApproximateSize records the approximate size (in bytes) and number of
+// keys of a Region.
+func (c *RegionCache) UpdateApproximateSize(regionID uint64, size, keys uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mu.sizes[regionID] = regionSize{size: size, keys: keys}
+}
+
+// ApproximateSize returns the approximate size (in bytes) and number of keys of
+// a Region. ok is false if they are unknown.
+func (c *RegionCache) ApproximateSize(regionID uint64) (size, keys uint64, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s, ok := c.mu.sizes[regionID]
+	return s.size, s.keys, ok
+}
+
+// SetReloadTimeout sets the timeout of loading a Region from PD. A load that
+// times out fails with ErrRegionReloadTimeout instead of being retried, and
+// the request that triggers it returns the error. Zero means no timeout.
+func (c *RegionCache) SetReloadTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.reloadTimeout, int64(timeout))
+}
+
+// addSendFail increases and returns the number of consecutive send failures
+// of addr.
+func (c *RegionCache) addSendFail(addr string) int {
+	c.sendFails.Lock()
+	defer c.sendFails.Unlock()
+
+	c.sendFails.m[addr]++
+	return c.sendFails.m[addr]
+}
+
+// resetSendFail clears the send failures of addr.
+func (c *RegionCache) resetSendFail(addr string) {
+	c.sendFails.RLock()
+	_, ok := c.sendFails.m[addr]
+	c.sendFails.RUnlock()
+	if !ok {
+		return
+	}
+	c.sendFails.Lock()
+	delete(c.sendFails.m, addr)
+	c.sendFails.Unlock()
+}
+
 // DropRegion removes a cached Region.
 func (c *RegionCache) DropRegion(id RegionVerID) {
 	c.mu.Lock()
@@ -110,10 +219,48 @@ func (c *RegionCache) DropRegion(id RegionVerID) {
 	c.dropRegionFromCache(id)
 }
 
+// InvalidateStore drops the cached store and the cached Regions whose current
+// peer is on it, so they are loaded from PD again by the next requests. It's
+// for stores that are removed or have changed address. It returns the number
+// of Regions dropped.
+func (c *RegionCache) InvalidateStore(storeID uint64) int {
+	c.stores.Lock()
+	delete(c.stores.m, storeID)
+	c.stores.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var dropped int
+	for id, r := range c.mu.regions {
+		if r.peer.GetStoreId() == storeID {
+			c.dropRegionFromCache(id)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// storeChanged returns whether store from PD is tombstone, or has changed
+// address since it's cached.
+func (c *RegionCache) storeChanged(store *metapb.Store) bool {
+	if store.GetState() == metapb.StoreState_Tombstone {
+		return true
+	}
+	c.stores.RLock()
+	cached, ok := c.stores.m[store.GetId()]
+	c.stores.RUnlock()
+	return ok && cached.GetAddress() != store.GetAddress()
+}
+
 // NextPeer picks next peer as new leader, if out of range of peers delete region.
+// The peer is picked by the PeerSelector if it's set.
 func (c *RegionCache) NextPeer(id RegionVerID) {
 	// A and B get the same region and current leader is 1, they both will pick
 	// peer 2 as leader.
+	if sel := c.getPeerSelector(); sel != nil {
+		c.nextPeerBySelector(id, sel)
+		return
+	}
 	region := c.GetRegionByVerID(id)
 	if region == nil {
 		return
@@ -125,6 +272,23 @@ func (c *RegionCache) NextPeer(id RegionVerID) {
 	}
 }
 
+// DampenNotLeader tells whether a `NotLeader` of the Region should be ignored
+// once, so the cached leader is retried. It returns true for the first
+// `NotLeader` within window, and false for the following one, after which the
+// leader should be updated as usual.
+func (c *RegionCache) DampenNotLeader(id RegionVerID, window time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if t, ok := c.mu.notLeaderAt[id]; ok && now.Sub(t) < window {
+		delete(c.mu.notLeaderAt, id)
+		return false
+	}
+	c.mu.notLeaderAt[id] = now
+	return true
+}
+
 // UpdateLeader update some region cache with newer leader info.
 func (c *RegionCache) UpdateLeader(regionID RegionVerID, leaderID uint64) {
 	c.mu.Lock()
@@ -136,21 +300,67 @@ func (c *RegionCache) UpdateLeader(regionID RegionVerID, leaderID uint64) {
 		return
 	}
 
-	var found bool
+	idx := -1
 	for i, p := range r.meta.Peers {
 		if p.GetId() == leaderID {
-			r.curPeerIdx, r.peer = i, p
-			found = true
+			idx = i
 			break
 		}
 	}
-	if !found {
+	if idx == -1 {
 		log.Debugf("regionCache: cannot find peer when updating leader %d,%d", regionID, leaderID)
 		c.dropRegionFromCache(r.VerID())
 		return
 	}
+	c.switchPeer(r, idx)
+}
+
+// RemovePeer removes a peer from a cached Region, it is used when the peer is
+// found not in the Region anymore. If the peer is current peer, the next peer
+// is picked. The Region is dropped if it has no peer left.
+func (c *RegionCache) RemovePeer(regionID RegionVerID, peerID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.mu.regions[regionID]
+	if !ok {
+		return
+	}
+	for i, p := range r.meta.Peers {
+		if p.GetId() != peerID {
+			continue
+		}
+		r.meta.Peers = append(r.meta.Peers[:i], r.meta.Peers[i+1:]...)
+		if len(r.meta.Peers) == 0 {
+			c.dropRegionFromCache(regionID)
+			return
+		}
+		if i < r.curPeerIdx {
+			r.curPeerIdx--
+		} else if i == r.curPeerIdx {
+			c.switchPeer(r, i%len(r.meta.Peers))
+		}
+		return
+	}
+}
+
+// ConfirmLeader marks that the Region's current peer is confirmed to be the
+// leader by a successful response. It is reset when the peer is switched.
+func (c *RegionCache) ConfirmLeader(regionID RegionVerID, peerID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r, ok := c.mu.regions[regionID]; ok && r.peer.GetId() == peerID {
+		r.leaderConfirmed = true
+	}
+}
 
-	store, err := c.pdClient.GetStore(r.peer.GetStoreId())
+// switchPeer makes the idx-th peer current peer of a cached Region. The Region
+// is dropped if failed to load the peer's store.
+func (c *RegionCache) switchPeer(r *Region, idx int) {
+	r.curPeerIdx, r.peer = idx, r.meta.Peers[idx]
+	r.leaderConfirmed = false
+	store, err := c.loadStore(r.peer.GetStoreId())
 	if err != nil {
 		log.Warnf("regionCache: failed load store %d", r.peer.GetStoreId())
 		c.dropRegionFromCache(r.VerID())
@@ -183,6 +393,7 @@ func (c *RegionCache) insertRegionToCache(r *Region) *Region {
 	}
 	old := c.mu.sorted.ReplaceOrInsert(newRBItem(r))
 	if old != nil {
+		regionCacheCounter.WithLabelValues("evict").Inc()
 		delete(c.mu.regions, old.(*llrbItem).region.VerID())
 	}
 	c.mu.regions[r.VerID()] = r
@@ -194,8 +405,10 @@ func (c *RegionCache) dropRegionFromCache(verID RegionVerID) {
 	if !ok {
 		return
 	}
+	regionCacheCounter.WithLabelValues("drop").Inc()
 	c.mu.sorted.Delete(newRBItem(r))
 	delete(c.mu.regions, r.VerID())
+	delete(c.mu.notLeaderAt, r.VerID())
 }
 
 // loadRegion loads region from pd client, and picks the first peer as leader.
@@ -209,7 +422,10 @@ func (c *RegionCache) loadRegion(bo *Backoffer, key []byte) (*Region, error) {
 			}
 		}
 
-		meta, leader, err := c.pdClient.GetRegion(key)
+		meta, leader, err := c.getRegionFromPD(key)
+		if errors.Cause(err) == ErrRegionReloadTimeout {
+			return nil, errors.Trace(err)
+		}
 		if err != nil {
 			backoffErr = errors.Errorf("loadRegion from PD failed, key: %q, err: %v", key, err)
 			continue
@@ -226,7 +442,7 @@ func (c *RegionCache) loadRegion(bo *Backoffer, key []byte) (*Region, error) {
 			moveLeaderToFirst(meta, leader.GetStoreId())
 		}
 		peer := meta.Peers[0]
-		store, err := c.pdClient.GetStore(peer.GetStoreId())
+		store, err := c.loadStore(peer.GetStoreId())
 		if err != nil {
 			backoffErr = errors.Errorf("loadStore from PD failed, key %q, storeID: %d, err: %v", key, peer.GetStoreId(), err)
 			continue
@@ -241,6 +457,35 @@ func (c *RegionCache) loadRegion(bo *Backoffer, key []byte) (*Region, error) {
 	}
 }
 
+// getRegionFromPD gets the Region of key from PD within reloadTimeout. PD
+// client cannot be canceled, so the call keeps running in background after
+// it times out.
+func (c *RegionCache) getRegionFromPD(key []byte) (*metapb.Region, *metapb.Peer, error) {
+	start := time.Now()
+	defer func() { regionReloadHistogram.Observe(time.Since(start).Seconds()) }()
+
+	timeout := time.Duration(atomic.LoadInt64(&c.reloadTimeout))
+	if timeout <= 0 {
+		return c.pdClient.GetRegion(key)
+	}
+	type result struct {
+		meta   *metapb.Region
+		leader *metapb.Peer
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		meta, leader, err := c.pdClient.GetRegion(key)
+		ch <- result{meta: meta, leader: leader, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.meta, r.leader, r.err
+	case <-time.After(timeout):
+		return nil, nil, errors.Annotatef(ErrRegionReloadTimeout, "key %q, timeout %v", key, timeout)
+	}
+}
+
 // OnRegionStale removes the old region and inserts new regions into the cache.
 func (c *RegionCache) OnRegionStale(old *Region, newRegions []*metapb.Region) error {
 	c.mu.Lock()
@@ -305,6 +550,9 @@ type Region struct {
 	peer       *metapb.Peer
 	addr       string
 	curPeerIdx int
+	// leaderConfirmed is true if peer has served a request after it became
+	// current peer, see RegionCache.ConfirmLeader.
+	leaderConfirmed bool
 }
 
 // Clone returns a copy of Region.
@@ -314,6 +562,8 @@ func (r *Region) Clone() *Region {
 		peer:       proto.Clone(r.peer).(*metapb.Peer),
 		addr:       r.addr,
 		curPeerIdx: r.curPeerIdx,
+
+		leaderConfirmed: r.leaderConfirmed,
 	}
 }
 
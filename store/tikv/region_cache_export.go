@@ -0,0 +1,101 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"encoding/json"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+// cacheStateVersion is the version of the format used by Export. Import
+// rejects data of unknown versions.
+const cacheStateVersion = 1
+
+type cacheState struct {
+	Version int           `json:"version"`
+	Regions []cachedState `json:"regions"`
+}
+
+type cachedState struct {
+	// Meta is the marshaled metapb.Region.
+	Meta    []byte `json:"meta"`
+	PeerIdx int    `json:"peer_idx"`
+	Addr    string `json:"addr"`
+}
+
+// Export serializes all cached Regions with their current peers and store
+// addresses, so that they can be loaded by Import of another RegionCache.
+func (c *RegionCache) Export() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	state := cacheState{Version: cacheStateVersion}
+	for _, r := range c.mu.regions {
+		meta, err := proto.Marshal(r.meta)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		state.Regions = append(state.Regions, cachedState{
+			Meta:    meta,
+			PeerIdx: r.curPeerIdx,
+			Addr:    r.addr,
+		})
+	}
+	data, err := json.Marshal(state)
+	return data, errors.Trace(err)
+}
+
+// Import loads Regions serialized by Export into cache. Regions already in
+// cache are kept. Imported Regions are not checked against PD, the outdated
+// ones are corrected by `StaleEpoch` and `NotLeader` errors like any other
+// cached Region when they are used.
+func (c *RegionCache) Import(data []byte) error {
+	var state cacheState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.Trace(err)
+	}
+	if state.Version != cacheStateVersion {
+		return errors.Errorf("unsupported region cache state version %d", state.Version)
+	}
+
+	regions := make([]*Region, 0, len(state.Regions))
+	for _, s := range state.Regions {
+		meta := &metapb.Region{}
+		if err := proto.Unmarshal(s.Meta, meta); err != nil {
+			return errors.Trace(err)
+		}
+		if s.PeerIdx < 0 || s.PeerIdx >= len(meta.GetPeers()) {
+			return errors.Errorf("invalid peer index %d of region %d", s.PeerIdx, meta.GetId())
+		}
+		regions = append(regions, &Region{
+			meta:       meta,
+			peer:       meta.Peers[s.PeerIdx],
+			addr:       s.Addr,
+			curPeerIdx: s.PeerIdx,
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range regions {
+		if c.getRegionFromCache(r.StartKey()) != nil {
+			continue
+		}
+		c.insertRegionToCache(r)
+	}
+	return nil
+}
@@ -15,9 +15,16 @@ package tikv
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/juju/errors"
 	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/pd/pd-client"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/store/tikv/mock-tikv"
 	"golang.org/x/net/context"
 )
@@ -239,3 +246,331 @@ func (s *testRegionCacheSuite) TestNextPeer(c *C) {
 	// Out of range of Peers, so get Region again and pick Stores[0] as leader.
 	c.Assert(region.curPeerIdx, Equals, 0)
 }
+
+func (s *testRegionCacheSuite) TestPeerSelector(c *C) {
+	store3, peer3 := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(store3, s.storeAddr(store3))
+	s.cluster.AddPeer(s.region1, store3, peer3)
+	s.cache.stores.m[store3] = &metapb.Store{Id: store3, Address: s.storeAddr(store3), Tags: []string{"zone=local"}}
+	s.cache.SetPeerSelector(TagPeerSelector{Tag: "ZONE=local"})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(region.peer.GetId(), Equals, s.peer1)
+	// The peer in local zone is tried first.
+	s.cache.NextPeer(region.VerID())
+	region = s.cache.GetRegionByVerID(region.VerID())
+	c.Assert(region.peer.GetId(), Equals, peer3)
+	c.Assert(region.GetAddress(), Equals, s.storeAddr(store3))
+	// The skipped peer is tried next.
+	s.cache.NextPeer(region.VerID())
+	region = s.cache.GetRegionByVerID(region.VerID())
+	c.Assert(region.peer.GetId(), Equals, s.peer2)
+	// All peers are tried, the region is dropped.
+	s.cache.NextPeer(region.VerID())
+	c.Assert(s.cache.GetRegionByVerID(region.VerID()), IsNil)
+}
+
+func (s *testRegionCacheSuite) TestApproximateSize(c *C) {
+	_, _, ok := s.cache.ApproximateSize(s.region1)
+	c.Assert(ok, IsFalse)
+	s.cache.UpdateApproximateSize(s.region1, 1024, 10)
+	size, keys, ok := s.cache.ApproximateSize(s.region1)
+	c.Assert(ok, IsTrue)
+	c.Assert(size, Equals, uint64(1024))
+	c.Assert(keys, Equals, uint64(10))
+}
+
+func (s *testRegionCacheSuite) TestRemovePeer(c *C) {
+	r, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	s.cache.RemovePeer(r.VerID(), s.peer1)
+	r = s.cache.GetRegionByVerID(r.VerID())
+	c.Assert(r.meta.GetPeers(), HasLen, 1)
+	c.Assert(r.GetAddress(), Equals, s.storeAddr(s.store2))
+
+	s.cache.RemovePeer(r.VerID(), s.peer2)
+	c.Assert(s.cache.GetRegionByVerID(r.VerID()), IsNil)
+	s.checkCache(c, 0)
+}
+
+func (s *testRegionCacheSuite) TestExportImport(c *C) {
+	// ['' - 'm' - 'z']
+	region2 := s.cluster.AllocID()
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, region2, []byte("m"), newPeers, newPeers[0])
+
+	r1, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	_, err = s.cache.GetRegion(s.bo, []byte("x"))
+	c.Assert(err, IsNil)
+	s.cache.UpdateLeader(r1.VerID(), s.peer2)
+	data, err := s.cache.Export()
+	c.Assert(err, IsNil)
+
+	old := s.cache
+	s.cache = NewRegionCache(old.pdClient)
+	c.Assert(s.cache.Import(data), IsNil)
+	s.checkCache(c, 2)
+	for id, r := range old.mu.regions {
+		c.Assert(s.cache.mu.regions[id], DeepEquals, r)
+	}
+	r := s.cache.getRegionFromCache([]byte("a"))
+	c.Assert(r.GetAddress(), Equals, s.storeAddr(s.store2))
+
+	c.Assert(s.cache.Import([]byte(`{"version":0}`)), NotNil)
+}
+
+func (s *testRegionCacheSuite) TestWarmUp(c *C) {
+	// ['' - 'm' - 't' - '']
+	regions := s.cluster.AllocIDs(2)
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, regions[0], []byte("m"), newPeers, newPeers[0])
+	newPeers = s.cluster.AllocIDs(2)
+	s.cluster.Split(regions[0], regions[1], []byte("t"), newPeers, newPeers[0])
+
+	loaded, err := s.cache.PrefetchRange(context.Background(), []byte("b"), []byte("n"))
+	c.Assert(err, IsNil)
+	c.Assert(loaded, Equals, 2)
+	s.checkCache(c, 2)
+	loaded, err = s.cache.PrefetchRange(context.Background(), nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(loaded, Equals, 3)
+	s.checkCache(c, 3)
+
+	s.cache = NewRegionCache(s.cache.pdClient)
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("n"), []byte("x")}
+	loaded, err = s.cache.WarmRegions(context.Background(), keys, 2)
+	c.Assert(err, IsNil)
+	c.Assert(loaded, Equals, len(keys))
+	s.checkCache(c, 3)
+
+	s.cache = NewRegionCache(s.cache.pdClient)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	loaded, err = s.cache.WarmRegions(ctx, keys, 2)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+	c.Assert(loaded < len(keys), IsTrue)
+	loaded, err = s.cache.PrefetchRange(ctx, nil, nil)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+	c.Assert(loaded, Equals, 0)
+}
+
+type slowPDClient struct {
+	pd.Client
+	delay time.Duration
+}
+
+func (c *slowPDClient) GetRegion(key []byte) (*metapb.Region, *metapb.Peer, error) {
+	time.Sleep(c.delay)
+	return c.Client.GetRegion(key)
+}
+
+func (s *testRegionCacheSuite) TestReloadTimeout(c *C) {
+	s.cache = NewRegionCache(&slowPDClient{Client: s.cache.pdClient, delay: 100 * time.Millisecond})
+	s.cache.SetReloadTimeout(10 * time.Millisecond)
+	_, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(errors.Cause(err), Equals, ErrRegionReloadTimeout)
+	s.checkCache(c, 0)
+
+	s.cache.SetReloadTimeout(0)
+	r, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(r.GetID(), Equals, s.region1)
+}
+
+// failAddrClient fails the requests sent to addr.
+type failAddrClient struct {
+	Client
+	addr string
+}
+
+func (c *failAddrClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	if addr == c.addr {
+		return nil, errors.New("connection refused")
+	}
+	return c.Client.SendKVReq(ctx, addr, req, timeout)
+}
+
+func (s *testRegionCacheSuite) TestHealthSweep(c *C) {
+	_, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	client := &failAddrClient{
+		Client: mocktikv.NewRPCClient(s.cluster, mocktikv.NewMvccStore()),
+		addr:   s.storeAddr(s.store2),
+	}
+	sweeper := NewHealthSweeper(s.cache, client, HealthSweepConfig{
+		Interval:     10 * time.Millisecond,
+		Concurrency:  2,
+		ProbeTimeout: time.Second,
+	})
+	c.Assert(sweeper.LastSweep().IsZero(), IsTrue)
+	for i := 0; i < 100 && s.cache.StoreReachable(s.store2); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sweeper.Close()
+	c.Assert(s.cache.StoreReachable(s.store2), IsFalse)
+	c.Assert(s.cache.StoreReachable(s.store1), IsTrue)
+	_, ok := s.cache.StoreLatency(s.store1)
+	c.Assert(ok, IsTrue)
+	_, ok = s.cache.StoreLatency(s.store2)
+	c.Assert(ok, IsFalse)
+
+	last := sweeper.LastSweep()
+	c.Assert(last.IsZero(), IsFalse)
+	time.Sleep(30 * time.Millisecond)
+	c.Assert(sweeper.LastSweep(), Equals, last)
+}
+
+func (s *testRegionCacheSuite) TestHealthSweepDefaults(c *C) {
+	sweeper := NewHealthSweeper(s.cache, mocktikv.NewRPCClient(s.cluster, mocktikv.NewMvccStore()), HealthSweepConfig{})
+	defer sweeper.Close()
+	c.Assert(sweeper.cfg.Interval, Equals, defaultHealthSweepInterval)
+	c.Assert(sweeper.cfg.ProbeTimeout, Equals, defaultHealthProbeTimeout)
+	c.Assert(sweeper.cfg.Concurrency, Equals, 1)
+}
+
+func (s *testRegionCacheSuite) TestInvalidateStore(c *C) {
+	r, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(s.cache.InvalidateStore(s.store2), Equals, 0)
+	c.Assert(s.cache.GetRegionByVerID(r.VerID()), NotNil)
+	c.Assert(s.cache.InvalidateStore(s.store1), Equals, 1)
+	c.Assert(s.cache.GetRegionByVerID(r.VerID()), IsNil)
+
+	// The sweeper finds the new address of the store.
+	r, err = s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	sweeper := NewHealthSweeper(s.cache, mocktikv.NewRPCClient(s.cluster, mocktikv.NewMvccStore()), HealthSweepConfig{
+		Interval:     time.Hour,
+		ProbeTimeout: time.Second,
+	})
+	defer sweeper.Close()
+	sweeper.probe(s.store1)
+	c.Assert(s.cache.GetRegionByVerID(r.VerID()), NotNil)
+	s.cluster.UpdateStoreAddr(s.store1, "store1-new")
+	sweeper.probe(s.store1)
+	c.Assert(s.cache.GetRegionByVerID(r.VerID()), IsNil)
+	r, err = s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(r.GetAddress(), Equals, "store1-new")
+
+	// And tombstones.
+	s.cluster.MarkTombstone(s.store1)
+	sweeper.probe(s.store1)
+	c.Assert(s.cache.GetRegionByVerID(r.VerID()), IsNil)
+}
+
+func (s *testRegionCacheSuite) TestRegionRefresh(c *C) {
+	r, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	region2 := s.cluster.AllocID()
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, region2, []byte("m"), newPeers, newPeers[0])
+
+	refresher := NewRegionRefresher(s.cache, RegionRefreshConfig{Interval: 10 * time.Millisecond})
+	c.Assert(refresher.LastRefresh().IsZero(), IsTrue)
+	for i := 0; i < 100 && (s.cache.GetRegionByVerID(r.VerID()) != nil || refresher.LastRefresh().IsZero()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	refresher.Close()
+	c.Assert(s.cache.GetRegionByVerID(r.VerID()), IsNil)
+	c.Assert(refresher.LastRefresh().IsZero(), IsFalse)
+
+	// The new Region of the start key is cached.
+	s.cache.mu.RLock()
+	cached := s.cache.getRegionFromCache([]byte("a"))
+	s.cache.mu.RUnlock()
+	c.Assert(cached, NotNil)
+	c.Assert(cached.GetID(), Equals, s.region1)
+	c.Assert(cached.EndKey(), DeepEquals, []byte("m"))
+
+	refresher = NewRegionRefresher(s.cache, RegionRefreshConfig{})
+	c.Assert(refresher.cfg.Interval, Equals, defaultRegionRefreshInterval)
+	refresher.Close()
+}
+
+func (s *testRegionCacheSuite) TestStoreLatencyP99(c *C) {
+	_, ok := s.cache.StoreLatencyP99(s.store1)
+	c.Assert(ok, IsFalse)
+	for i := 1; i <= 200; i++ {
+		s.cache.reportStoreResult(s.store1, time.Duration(i)*time.Millisecond, true)
+	}
+	// Only the latest 128 samples, 73ms to 200ms, are kept.
+	p99, ok := s.cache.StoreLatencyP99(s.store1)
+	c.Assert(ok, IsTrue)
+	c.Assert(p99, Equals, 199*time.Millisecond)
+
+	s.cache.reportStoreBusy(s.store2)
+	s.cache.reportStoreResult(s.store2, 0, false)
+	s.cache.reportStoreResult(s.store2, 0, false)
+	healths := s.cache.StoreHealths()
+	c.Assert(healths, HasLen, 2)
+	c.Assert(healths[s.store1].Reachable, IsTrue)
+	c.Assert(healths[s.store1].P99, Equals, p99)
+	c.Assert(healths[s.store1].Latency > 0, IsTrue)
+	c.Assert(healths[s.store2], DeepEquals, StoreHealthInfo{Reachable: false, Busy: true})
+}
+
+func (s *testRegionCacheSuite) TestRangeTask(c *C) {
+	// ['' - 'm' - '']
+	region2 := s.cluster.AllocID()
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, region2, []byte("m"), newPeers, newPeers[0])
+
+	var mu sync.Mutex
+	var ranges []string
+	collect := func(ctx context.Context, r kv.KeyRange) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ranges = append(ranges, fmt.Sprintf("[%s,%s)", r.StartKey, r.EndKey))
+		return nil
+	}
+	runner := NewRangeTaskRunner("test", s.cache, 2, collect)
+	stat, err := runner.RunOnRange(context.Background(), []byte("c"), []byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(stat.CompletedRegions, Equals, 2)
+	sort.Strings(ranges)
+	c.Assert(ranges, DeepEquals, []string{"[c,m)", "[m,x)"})
+
+	// Failures don't stop the other ranges.
+	fail := errors.New("fail")
+	runner = NewRangeTaskRunner("test", s.cache, 2, func(ctx context.Context, r kv.KeyRange) error {
+		if string(r.StartKey) == "m" {
+			return fail
+		}
+		return nil
+	})
+	stat, err = runner.RunOnRange(context.Background(), nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(stat.CompletedRegions, Equals, 1)
+	c.Assert(stat.Failures, HasLen, 1)
+	c.Assert(string(stat.Failures[0].Range.StartKey), Equals, "m")
+	c.Assert(stat.Failures[0].Err, Equals, fail)
+
+	// The range of a Region split while the handler runs is split again.
+	r, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	ranges = nil
+	var split bool
+	runner = NewRangeTaskRunner("test", s.cache, 1, func(ctx context.Context, kr kv.KeyRange) error {
+		if !split {
+			split = true
+			s.cluster.Split(s.region1, s.cluster.AllocID(), []byte("f"), s.cluster.AllocIDs(2), newPeers[0])
+			s.cache.DropRegion(r.VerID())
+			return fail
+		}
+		return collect(ctx, kr)
+	})
+	stat, err = runner.RunOnRange(context.Background(), nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Failures, HasLen, 0)
+	c.Assert(stat.CompletedRegions, Equals, 3)
+	c.Assert(ranges, DeepEquals, []string{"[,f)", "[f,m)", "[m,)"})
+
+	// Canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewRangeTaskRunner("test", s.cache, 1, collect).RunOnRange(ctx, nil, nil)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+// WarmRegions loads the Regions of keys into cache, with at most concurrency
+// loads from PD at a time. It stops early when ctx is done or a load fails,
+// and returns the number of keys whose Regions are cached. A load already
+// sent to PD is not interrupted by ctx, but no load starts after ctx is done.
+func (c *RegionCache) WarmRegions(ctx context.Context, keys [][]byte, concurrency int) (int, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		loaded   int
+		firstErr error
+	)
+	ch := make(chan []byte)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bo := NewBackoffer(warmUpMaxBackoff, ctx)
+			for key := range ch {
+				_, err := c.GetRegion(bo, key)
+				mu.Lock()
+				if err == nil {
+					loaded++
+				} else if firstErr == nil {
+					firstErr = errors.Trace(err)
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+SendLoop:
+	for _, key := range keys {
+		select {
+		case ch <- key:
+		case <-ctx.Done():
+			break SendLoop
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	if firstErr != nil {
+		return loaded, firstErr
+	}
+	if loaded < len(keys) {
+		return loaded, errors.Trace(ctx.Err())
+	}
+	return loaded, nil
+}
+
+// PrefetchRange loads all Regions in [startKey, endKey) into cache, an empty
+// endKey means the end of the key space. The Regions are loaded one after
+// another, because the next Region is located by the end key of the previous
+// one. It stops early when ctx is done or a load fails, and returns the number
+// of Regions cached.
+func (c *RegionCache) PrefetchRange(ctx context.Context, startKey, endKey []byte) (int, error) {
+	bo := NewBackoffer(warmUpMaxBackoff, ctx)
+	var loaded int
+	key := startKey
+	for {
+		select {
+		case <-ctx.Done():
+			return loaded, errors.Trace(ctx.Err())
+		default:
+		}
+		region, err := c.GetRegion(bo, key)
+		if err != nil {
+			return loaded, errors.Trace(err)
+		}
+		loaded++
+		key = region.EndKey()
+		if len(key) == 0 || (len(endKey) > 0 && bytes.Compare(key, endKey) >= 0) {
+			return loaded, nil
+		}
+	}
+}
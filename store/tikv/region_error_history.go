@@ -0,0 +1,98 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+)
+
+// RecordedError is a region error returned by tikv, see
+// RegionCache.RecentRegionErrors.
+type RecordedError struct {
+	Time      time.Time
+	RegionID  uint64
+	StoreAddr string
+	// Err is the error as is, including the fields that the sender does not
+	// handle.
+	Err *errorpb.Error
+}
+
+// regionErrorHistory records the last region errors returned to the senders
+// of a RegionCache.
+type regionErrorHistory struct {
+	// enabled is set if the buffer is not empty, so region errors can be
+	// reported without locking if the history is disabled.
+	enabled int32
+	sync.Mutex
+	// buf is a ring buffer, next is the index to write the next error.
+	buf  []RecordedError
+	next int
+	full bool
+}
+
+// SetRegionErrorHistorySize makes the senders of the cache record the last n
+// region errors returned by tikv, which can be read by RecentRegionErrors.
+// Recorded errors are cleared. Zero disables recording.
+func (c *RegionCache) SetRegionErrorHistorySize(n int) {
+	h := &c.errHistory
+	h.Lock()
+	defer h.Unlock()
+
+	h.buf, h.next, h.full = nil, 0, false
+	if n > 0 {
+		h.buf = make([]RecordedError, n)
+	}
+	atomic.StoreInt32(&h.enabled, int32(len(h.buf)))
+}
+
+// RecentRegionErrors returns the recorded region errors, the oldest first.
+func (c *RegionCache) RecentRegionErrors() []RecordedError {
+	h := &c.errHistory
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.full {
+		return append([]RecordedError(nil), h.buf[:h.next]...)
+	}
+	return append(append([]RecordedError(nil), h.buf[h.next:]...), h.buf[:h.next]...)
+}
+
+func (c *RegionCache) recordRegionError(e *errorpb.Error, regionID uint64, addr string) {
+	h := &c.errHistory
+	if atomic.LoadInt32(&h.enabled) == 0 {
+		return
+	}
+	r := RecordedError{
+		Time:      time.Now(),
+		RegionID:  regionID,
+		StoreAddr: addr,
+		Err:       proto.Clone(e).(*errorpb.Error),
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.buf) == 0 {
+		return
+	}
+	h.buf[h.next] = r
+	h.next++
+	if h.next == len(h.buf) {
+		h.next, h.full = 0, true
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// RegionRefreshConfig is the config of RegionRefresher.
+type RegionRefreshConfig struct {
+	// Interval is the time between the start of two refreshes. Zero means
+	// 1m.
+	Interval time.Duration
+	// Concurrency is the max number of Regions loaded from PD at the same
+	// time. It's at least 1.
+	Concurrency int
+}
+
+// defaultRegionRefreshInterval is the default of RegionRefreshConfig.Interval.
+const defaultRegionRefreshInterval = time.Minute
+
+// RegionRefresher periodically loads the cached Regions from PD again, and
+// replaces those whose epoch has changed, so requests are routed by the new
+// epoch instead of failing with `StaleEpoch` first. A Region that is split
+// is replaced by the new Region of its start key, the other parts are loaded
+// on demand as usual.
+type RegionRefresher struct {
+	cache *RegionCache
+	cfg   RegionRefreshConfig
+	// lastRefresh is the UnixNano of the time when the last refresh finished.
+	lastRefresh int64
+	ctx         context.Context
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+// NewRegionRefresher creates a RegionRefresher and starts refreshing in
+// background.
+func NewRegionRefresher(cache *RegionCache, cfg RegionRefreshConfig) *RegionRefresher {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultRegionRefreshInterval
+	}
+	r := &RegionRefresher{
+		cache: cache,
+		cfg:   cfg,
+		done:  make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	go r.start()
+	return r
+}
+
+// Close stops the background goroutine and waits for it to exit. Loads already
+// sent to PD are not interrupted, but their results are discarded.
+func (r *RegionRefresher) Close() {
+	r.cancel()
+	<-r.done
+}
+
+// LastRefresh returns the time when the last refresh finished, zero if no
+// refresh has finished.
+func (r *RegionRefresher) LastRefresh() time.Time {
+	if t := atomic.LoadInt64(&r.lastRefresh); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+func (r *RegionRefresher) start() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refresh()
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *RegionRefresher) refresh() {
+	r.cache.mu.RLock()
+	regions := make([]*Region, 0, len(r.cache.mu.regions))
+	for _, region := range r.cache.mu.regions {
+		regions = append(regions, region)
+	}
+	r.cache.mu.RUnlock()
+
+	sem := make(chan struct{}, r.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for _, region := range regions {
+		if r.ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(region *Region) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r.refreshRegion(region)
+		}(region)
+	}
+	wg.Wait()
+	if r.ctx.Err() == nil {
+		atomic.StoreInt64(&r.lastRefresh, time.Now().UnixNano())
+	}
+}
+
+// refreshRegion loads the Region of the start key of cached from PD, and
+// replaces cached with it if the epoch has changed. It does nothing if cached
+// is no longer in cache.
+func (r *RegionRefresher) refreshRegion(cached *Region) {
+	bo := NewBackoffer(warmUpMaxBackoff, r.ctx)
+	region, err := r.cache.loadRegion(bo, cached.StartKey())
+	if err != nil {
+		if r.ctx.Err() == nil {
+			log.Warnf("region refresh: failed load region %d: %v", cached.GetID(), err)
+		}
+		return
+	}
+	if r.ctx.Err() != nil || region.VerID() == cached.VerID() {
+		return
+	}
+
+	c := r.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.mu.regions[cached.VerID()]; !ok {
+		return
+	}
+	log.Infof("region refresh: region %v is replaced by %v", cached.VerID(), region.VerID())
+	c.dropRegionFromCache(cached.VerID())
+	c.insertRegionToCache(region)
+}
@@ -14,85 +14,1118 @@
 package tikv
 
 import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"golang.org/x/net/context"
 )
 
-// sendKVReq sends req to tikv server. It will retry internally to find the right
-// region leader if i) fails to establish a connection to server or ii) server
-// returns `NotLeader`.
-func sendKVReq(regionCache *RegionCache, rpcClient Client, bo *Backoffer, req *kvrpcpb.Request, regionID RegionVerID, timeout time.Duration) (*kvrpcpb.Response, error) {
+// requestSeq is the sequence number of the last request, see ResultMeta.Seq.
+var requestSeq uint64
+
+// requestValidation is set to 1 if requests should be checked before they are
+// sent to tikv server.
+var requestValidation int32
+
+// SetRequestValidation enables or disables checking requests for missing
+// fields before they are sent. It is meant for debugging because it adds
+// extra checks to every request.
+func SetRequestValidation(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&requestValidation, v)
+}
+
+func requestValidationEnabled() bool {
+	return atomic.LoadInt32(&requestValidation) == 1
+}
+
+// RegionRequestSender sends KV/Cop requests to tikv server. It handles network
+// errors and some region errors internally.
+//
+// Typically, a KV/Cop request is bind to a region, all keys that are involved
+// in the request should be located in the region.
+// The sending process begins with looking for the address of leader store's
+// address of the target region from cache, and the request is then sent to the
+// destination tikv server over TCP connection.
+// If region is updated, can be caused by leader transfer, region split, region
+// merge, or region balance, tikv server may not able to process request and
+// send back a RegionError.
+// RegionRequestSender takes care of errors that does not relevant to region
+// range, such as 'I/O timeout', 'NotLeader', and 'ServerIsBusy'. For other
+// errors, since region range have changed, the request may need to split, so we
+// simply return the error to caller.
+type RegionRequestSender struct {
+	bo          *Backoffer
+	regionCache *RegionCache
+	client      Client
+
+	// InlineReloadOnDrop makes the sender reload the region from PD right
+	// after it is dropped for `RegionNotFound` or `KeyNotInRegion`, so the
+	// request can be retried within the same call instead of bouncing back
+	// to caller with a `StaleEpoch` error.
+	InlineReloadOnDrop bool
+	// ReadOnlyCache makes the sender never update the region cache. WARNING:
+	// it disables all self-healing for the request. Send failures are retried
+	// against the same peer, and region errors other than `ServerIsBusy` are
+	// returned to caller as is, without updating leader, dropping the region
+	// or loading new regions. It is meant for tools that must not perturb the
+	// cache shared by other requests.
+	ReadOnlyCache bool
+	// ResponseProcessors are applied in order to the final successful
+	// response of a KV request. Responses with region errors, including the
+	// ones of retried attempts, are not processed.
+	ResponseProcessors []ResponseProcessor
+	// CacheMissPolicy decides what to do if the target region of a KV request
+	// is not in cache anymore. It is ignored if ReadOnlyCache is set.
+	CacheMissPolicy CacheMissPolicy
+	// ConfirmLeaderMinSize enables probing the leader with a small read
+	// before sending a write request of at least ConfirmLeaderMinSize bytes,
+	// if the cached leader has not served any request since it was updated.
+	// It saves resending a large write after `NotLeader`. Zero disables it.
+	ConfirmLeaderMinSize int
+	// RecordTimeline makes the sender record each attempt and backoff of a
+	// request, which can be read by Timeline after the request returns.
+	RecordTimeline bool
+	// AddrRewriter translates the address of a store to the address that is
+	// actually dialed, e.g. the address of a proxy. The cache and all
+	// records keep the store's own address. Nil means dialing it directly.
+	AddrRewriter func(storeID uint64, addr string) string
+	// MinHealthyReplicas makes the sender fail a write request fast with
+	// ErrInsufficientReplicas, instead of sending it, if fewer replicas of
+	// the region are reachable, see RegionCache.StoreReachable. Zero
+	// disables the check.
+	MinHealthyReplicas int
+	// CheckKeyRange makes the sender check the keys of a KV request against
+	// the range of the cached region before sending it. If some keys are out
+	// of the range, the request is routed by stale region boundaries. The
+	// region is dropped, and the request is sent to the region reloaded for
+	// the keys, or a `StaleEpoch`
+	// error is returned if the keys are in different regions now. With
+	// ReadOnlyCache, the error is returned without touching the cache.
+	CheckKeyRange bool
+	// KVTimeoutEstimator and CopTimeoutEstimator give the timeout of a
+	// request if caller passes a zero timeout. Nil means DefaultKVTimeout
+	// and DefaultCopTimeout.
+	KVTimeoutEstimator  KVTimeoutEstimator
+	CopTimeoutEstimator CopTimeoutEstimator
+	// LastChanceRead makes the sender send a read request once more, without
+	// backoff, if it's going to fail because backoff is exhausted while
+	// handling a region error. If the last attempt fails too, the original
+	// error is returned. Writes are never retried this way.
+	LastChanceRead bool
+	// MaxRetries and MaxRetryTime bound the retries of a request. The
+	// request fails with ErrRetryExhausted when it is going to be retried
+	// more than MaxRetries times, or MaxRetryTime after it's sent. All
+	// retries count, whatever the cause. Zero means no limit.
+	MaxRetries   int
+	MaxRetryTime time.Duration
+	// RegionErrorHook is called with the region error of every response
+	// received, nil if there is none, and the returned error replaces it.
+	// It lets tests inject or rewrite region errors. Nil means responses
+	// are used as is.
+	RegionErrorHook func(*errorpb.Error) *errorpb.Error
+	// StrictWriteRetry makes the sender retry a write request after a send
+	// failure only if the request is surely not sent, e.g. the connection
+	// cannot be established. If it may have reached tikv, the request fails
+	// with ErrResultUndetermined instead of being applied twice.
+	StrictWriteRetry bool
+	// AuditSink receives a record of each request sent by the sender. Nil
+	// disables auditing.
+	AuditSink AuditSink
+
+	// cfg is loaded when the sender is created, or by the next request after
+	// Reconfigure, so a running request is not affected by reconfiguring.
+	cfg         *SenderConfig
+	cfgOverride atomic.Value
+	meta        ResultMeta
+	stats       RequestStats
+	// runtimeStats is read from the context of the Backoffer, see
+	// WithRuntimeStats.
+	runtimeStats *RuntimeStats
+	// storeAddr and peerID are the address of the store and the peer that
+	// the last attempt is sent to.
+	storeAddr string
+	peerID    uint64
+	// start is the time the request is sent.
+	start time.Time
+	// retries is the number of times the request is retried.
+	retries int
+	// trace is the trace of the running request, nil if trace is disabled.
+	trace *RequestTrace
+	// span is the span of the running request, nil if it's not traced.
+	span     Span
+	spanCtx  context.Context
+	timeline []RetrySegment
+	attempts []PeerAttempt
+	// maybeApplied is set if sending a write request has failed, so the
+	// write may have been applied.
+	maybeApplied bool
+	// lastChanceErr is the error that the last chance is taken for, see
+	// LastChanceRead.
+	lastChanceErr error
+	// lastRegionErr is the last region error of the request.
+	lastRegionErr *errorpb.Error
+}
+
+// CacheMissPolicy is the policy of handling a KV request whose target region
+// is dropped from cache.
+type CacheMissPolicy int
+
+// CacheMissPolicy values.
+const (
+	// CacheMissStaleEpoch returns a `StaleEpoch` error to caller without
+	// sending the request, so the caller can re-split the request by the
+	// latest regions. It is the default.
+	CacheMissStaleEpoch CacheMissPolicy = iota
+	// CacheMissReloadWrites reloads the region and retries write requests
+	// inline if all their keys are still in one region. Read requests are
+	// handled as CacheMissStaleEpoch.
+	CacheMissReloadWrites
+	// CacheMissReload is like CacheMissReloadWrites but for all requests.
+	CacheMissReload
+)
+
+// RequestStats counts the retries of the request sent by RegionRequestSender.
+type RequestStats struct {
+	// NotLeader, StaleEpoch and ServerBusy are the numbers of the region
+	// errors tikv reports.
+	NotLeader  int
+	StaleEpoch int
+	ServerBusy int
+	// SendFail is the number of failed sends, not counting the ones
+	// interrupted by canceling the request.
+	SendFail int
+	// BackoffTime is the total time spent in backoff.
+	BackoffTime time.Duration
+}
+
+// ResultMeta is the metadata of the request sent by RegionRequestSender.
+type ResultMeta struct {
+	// Seq is the sequence number of the request. Requests are numbered in
+	// the order they are issued by all senders in the process, starting
+	// from 1. It wraps around after math.MaxUint64.
+	Seq uint64
+	// ApproximateSize and ApproximateKeys are the approximate size in bytes
+	// and number of keys of the region that served the request. They are
+	// zero if unknown.
+	ApproximateSize uint64
+	ApproximateKeys uint64
+	// TouchedPD is set if serving the request has loaded regions or stores
+	// from PD, e.g. reloading a region missing in cache or switching to
+	// another peer. It's false if the request is served from cache only.
+	TouchedPD bool
+	// CommitTS is the commit ts of the keys written by a successful Commit,
+	// zero for other requests.
+	CommitTS uint64
+}
+
+// NewRegionRequestSender creates a new sender.
+func NewRegionRequestSender(bo *Backoffer, regionCache *RegionCache, client Client) *RegionRequestSender {
+	return &RegionRequestSender{
+		bo:          bo,
+		regionCache: regionCache,
+		client:      client,
+		cfg:         regionCache.senderConfig(),
+	}
+}
+
+// SendKVReq sends a KV request to tikv server. A zero timeout means the
+// timeout given by KVTimeoutEstimator.
+func (s *RegionRequestSender) SendKVReq(req *kvrpcpb.Request, regionID RegionVerID, timeout time.Duration) (*kvrpcpb.Response, error) {
+	start := s.reset()
+	s.startTrace(req.GetType().String(), regionID, start)
+	s.startSpan(SpanSendKVReq, regionID)
+	resp, err := s.sendKVReq(req, regionID, s.kvTimeout(req, timeout))
+	s.audit(req.GetType().String(), regionID, start, resp.GetRegionError(), err)
+	requestRetryHistogram.Observe(float64(s.retries))
+	s.finishTrace(resp.GetRegionError(), err)
+	s.finishSpan(resp.GetRegionError(), err)
+	return resp, s.withAdvice(s.withTarget(regionID, err))
+}
+
+// reset clears the results and the state of the last request, so a sender can
+// be reused. It returns the start time of the new request.
+func (s *RegionRequestSender) reset() time.Time {
+	s.loadConfig()
+	s.meta.Seq = atomic.AddUint64(&requestSeq, 1)
+	s.meta.TouchedPD, s.meta.CommitTS = false, 0
+	s.lastChanceErr, s.lastRegionErr, s.maybeApplied = nil, nil, false
+	start := time.Now()
+	s.start, s.retries = start, 0
+	s.storeAddr, s.peerID = "", 0
+	s.timeline, s.attempts = nil, nil
+	s.stats = RequestStats{}
+	if s.runtimeStats = runtimeStatsOf(s.bo.ctx); s.runtimeStats != nil {
+		s.runtimeStats.recordRequest()
+	}
+	return start
+}
+
+// loadConfig picks up the config set by Reconfigure.
+func (s *RegionRequestSender) loadConfig() {
+	if cfg, ok := s.cfgOverride.Load().(*SenderConfig); ok {
+		s.cfg = cfg
+	}
+}
+
+func (s *RegionRequestSender) sendKVReq(req *kvrpcpb.Request, regionID RegionVerID, timeout time.Duration) (*kvrpcpb.Response, error) {
+	if requestValidationEnabled() {
+		if err := validateKVRequest(req); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if _, isWrite := requestKeys(req); isWrite {
+		s.invalidateReadCache(regionID.id, req)
+	}
+
+	var reloaded bool
 	for {
 		select {
-		case <-bo.ctx.Done():
-			return nil, errors.Trace(bo.ctx.Err())
+		case <-s.bo.ctx.Done():
+			return nil, errors.Trace(s.bo.ctx.Err())
 		default:
 		}
+		if err := s.checkRetryBudget(); err != nil {
+			return nil, errors.Trace(err)
+		}
 
-		region := regionCache.GetRegionByVerID(regionID)
+		region := s.regionCache.GetRegionByVerID(regionID)
+		if region == nil && !reloaded {
+			// Reload the region at most once, so the request cannot loop
+			// forever if the reloaded region is dropped again.
+			reloaded = true
+			var err error
+			region, err = s.reloadOnCacheMiss(req)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		if region != nil && s.CheckKeyRange && !regionContainsKeys(region, req) {
+			log.Warnf("keys of %s request are out of cached region %d, reload region", req.GetType(), region.GetID())
+			if !s.ReadOnlyCache {
+				s.regionCache.DropRegion(region.VerID())
+			}
+			region = nil
+			if !reloaded && !s.ReadOnlyCache {
+				reloaded = true
+				var err error
+				region, err = s.loadRegionOfKeys(req)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				if region != nil {
+					// Retries are sent to the reloaded region.
+					regionID = region.VerID()
+				}
+			}
+		}
 		if region == nil {
 			// If the region is not found in cache, it must be out
 			// of date and already be cleaned up. We can skip the
 			// RPC by returning RegionError directly.
+			s.traceEvent(TraceRegionMiss, time.Now(), "")
 			return &kvrpcpb.Response{
 				Type:        req.GetType(),
 				RegionError: &errorpb.Error{StaleEpoch: &errorpb.StaleEpoch{}},
 			}, nil
 		}
-		req.Context = region.GetContext()
-		resp, err := rpcClient.SendKVReq(region.GetAddress(), req, timeout)
-		if err != nil {
-			regionCache.NextPeer(region.VerID())
-			err = bo.Backoff(boTiKVRPC, errors.Errorf("send tikv request error: %v, ctx: %s, try next peer later", err, req.Context))
+
+		if s.cfg.readCacheEnabled() {
+			if resp, ok := s.regionCache.reads.get(region.VerID(), req); ok {
+				readCacheCounter.WithLabelValues("hit").Inc()
+				return s.processResponse(req, resp)
+			}
+		}
+
+		if probe := s.leaderProbe(region, req); probe != nil {
+			probeResp, retry, err := s.sendKVReqToRegion(region, probe, timeout)
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
-			continue
-		}
-		if regionErr := resp.GetRegionError(); regionErr != nil {
-			reportRegionError(regionErr)
-			// Retry if error is `NotLeader`.
-			if notLeader := regionErr.GetNotLeader(); notLeader != nil {
-				log.Warnf("tikv reports `NotLeader`: %s, ctx: %s, retry later", notLeader, req.Context)
-				regionCache.UpdateLeader(region.VerID(), notLeader.GetLeader().GetId())
-				if notLeader.GetLeader() == nil {
-					err = bo.Backoff(boRegionMiss, errors.Errorf("not leader: %v, ctx: %s", notLeader, req.Context))
-					if err != nil {
-						return nil, errors.Trace(err)
-					}
-				}
+			if retry {
+				s.retries++
 				continue
 			}
-			if staleEpoch := regionErr.GetStaleEpoch(); staleEpoch != nil {
-				log.Warnf("tikv reports `StaleEpoch`, ctx: %s, retry later", req.Context)
-				err = regionCache.OnRegionStale(region, staleEpoch.NewRegions)
+			if regionErr := probeResp.GetRegionError(); regionErr != nil {
+				retry, err = s.onRegionError(region, regionErr)
 				if err != nil {
 					return nil, errors.Trace(err)
 				}
-				continue
+				if retry {
+					s.retries++
+					continue
+				}
+				return &kvrpcpb.Response{Type: req.GetType(), RegionError: regionErr}, nil
 			}
-			// Retry if the error is `ServerIsBusy`.
-			if regionErr.GetServerIsBusy() != nil {
-				log.Warnf("tikv reports `ServerIsBusy`, ctx: %s, retry later", req.Context)
-				err = bo.Backoff(boServerBusy, errors.Errorf("server is busy"))
-				if err != nil {
-					return nil, errors.Trace(err)
+			s.regionCache.ConfirmLeader(region.VerID(), region.peer.GetId())
+		}
+
+		resp, retry, err := s.sendKVReqToRegion(region, req, timeout)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if retry {
+			s.retries++
+			continue
+		}
+
+		if regionErr := resp.GetRegionError(); regionErr != nil {
+			retry, err := s.onRegionError(region, regionErr)
+			if err != nil {
+				if _, isWrite := requestKeys(req); s.takeLastChance(!isWrite, err) {
+					s.retries++
+					continue
 				}
+				return nil, errors.Trace(err)
+			}
+			if retry {
+				s.retries++
 				continue
 			}
-			// For other errors, we only drop cache here.
-			// Because caller may need to re-split the request.
-			log.Warnf("tikv reports region error: %s, ctx: %s", resp.GetRegionError(), req.Context)
-			regionCache.DropRegion(region.VerID())
 			return resp, nil
 		}
+
 		if resp.GetType() != req.GetType() {
 			return nil, errors.Trace(errMismatch(resp, req))
 		}
+		if !s.ReadOnlyCache && !region.leaderConfirmed {
+			s.regionCache.ConfirmLeader(region.VerID(), region.peer.GetId())
+		}
+		s.fillResultMeta(region)
+		s.fillCommitTS(req, resp)
+		s.updateReadCache(region, req, resp)
+		return s.processResponse(req, resp)
+	}
+}
+
+// SendCopReq sends a coprocessor request to tikv server. A zero timeout means
+// the timeout given by CopTimeoutEstimator.
+func (s *RegionRequestSender) SendCopReq(req *coprocessor.Request, regionID RegionVerID, timeout time.Duration) (*coprocessor.Response, error) {
+	start := s.reset()
+	s.startTrace("Cop", regionID, start)
+	s.startSpan(SpanSendCopReq, regionID)
+	resp, err := s.sendCopReq(req, regionID, s.copTimeout(req, timeout))
+	s.audit("Cop", regionID, start, resp.GetRegionError(), err)
+	requestRetryHistogram.Observe(float64(s.retries))
+	s.finishTrace(resp.GetRegionError(), err)
+	s.finishSpan(resp.GetRegionError(), err)
+	return resp, s.withAdvice(s.withTarget(regionID, err))
+}
+
+func (s *RegionRequestSender) sendCopReq(req *coprocessor.Request, regionID RegionVerID, timeout time.Duration) (*coprocessor.Response, error) {
+	if requestValidationEnabled() {
+		if err := validateCopRequest(req); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	for {
+		select {
+		case <-s.bo.ctx.Done():
+			return nil, errors.Trace(s.bo.ctx.Err())
+		default:
+		}
+		if err := s.checkRetryBudget(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		region := s.regionCache.GetRegionByVerID(regionID)
+		if region == nil {
+			// If the region is not found in cache, it must be out
+			// of date and already be cleaned up. We can skip the
+			// RPC by returning RegionError directly.
+			s.traceEvent(TraceRegionMiss, time.Now(), "")
+			return &coprocessor.Response{
+				RegionError: &errorpb.Error{StaleEpoch: &errorpb.StaleEpoch{}},
+			}, nil
+		}
+
+		resp, retry, err := s.sendCopReqToRegion(region, req, timeout)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if retry {
+			s.retries++
+			continue
+		}
+
+		if regionErr := resp.GetRegionError(); regionErr != nil {
+			retry, err := s.onRegionError(region, regionErr)
+			if err != nil {
+				if s.takeLastChance(true, err) {
+					s.retries++
+					continue
+				}
+				return nil, errors.Trace(err)
+			}
+			if retry {
+				s.retries++
+				continue
+			}
+			return resp, nil
+		}
+		s.fillResultMeta(region)
 		return resp, nil
 	}
 }
+
+// Meta returns the metadata of the last request.
+func (s *RegionRequestSender) Meta() ResultMeta {
+	return s.meta
+}
+
+// Stats returns the retry statistics of the last request.
+func (s *RegionRequestSender) Stats() RequestStats {
+	return s.stats
+}
+
+// LastRegionError returns the last region error that the last request got
+// from tikv, nil if it got none. It tells why a request that fails with
+// ErrRetryExhausted or a backoff error kept retrying.
+func (s *RegionRequestSender) LastRegionError() *errorpb.Error {
+	return s.lastRegionErr
+}
+
+func (s *RegionRequestSender) fillResultMeta(region *Region) {
+	if size, keys, ok := s.regionCache.ApproximateSize(region.GetID()); ok {
+		s.meta.ApproximateSize, s.meta.ApproximateKeys = size, keys
+	}
+}
+
+// fillCommitTS sets CommitTS if req is a successful Commit. tikv does not
+// return the commit ts, but a Commit without KeyError makes the keys visible at
+// the commit version given by the request.
+func (s *RegionRequestSender) fillCommitTS(req *kvrpcpb.Request, resp *kvrpcpb.Response) {
+	if req.GetType() == kvrpcpb.MessageType_CmdCommit && resp.GetCmdCommitResp() != nil && resp.GetCmdCommitResp().GetError() == nil {
+		s.meta.CommitTS = req.GetCmdCommitReq().GetCommitVersion()
+	}
+}
+
+// rpcTimeout returns the timeout of an RPC sent to the store. It's extended
+// for busy stores, see SenderConfig.BusyTimeoutFactor, and shortened to the
+// deadline of the request's context, so retries cannot run past the deadline
+// of the caller. Retries are also shortened to what is left of MaxRetryTime.
+func (s *RegionRequestSender) rpcTimeout(storeID uint64, timeout time.Duration) time.Duration {
+	timeout = s.cfg.rpcTimeout(timeout)
+	if f := s.cfg.BusyTimeoutFactor; f > 0 && s.regionCache.StoreBusy(storeID) {
+		if latency, ok := s.regionCache.StoreLatency(storeID); ok {
+			if t := time.Duration(float64(latency) * f); t > timeout {
+				timeout = t
+			}
+		}
+	}
+	if deadline, ok := s.bo.ctx.Deadline(); ok {
+		if left := deadline.Sub(time.Now()); left < timeout {
+			timeout = left
+		}
+	}
+	if s.MaxRetryTime > 0 && s.retries > 0 {
+		if left := s.MaxRetryTime - time.Since(s.start); left < timeout {
+			timeout = left
+		}
+	}
+	return timeout
+}
+
+func (s *RegionRequestSender) sendKVReqToRegion(region *Region, req *kvrpcpb.Request, timeout time.Duration) (resp *kvrpcpb.Response, retry bool, err error) {
+	_, isWrite := requestKeys(req)
+	retry, err = s.sendToRegion(region, req.GetType().String(), req.Size(), isWrite, timeout, func(ctx *kvrpcpb.Context, addr string, timeout time.Duration) (*errorpb.Error, error) {
+		req.Context = ctx
+		var e error
+		if resp, e = s.client.SendKVReq(s.bo.ctx, addr, req, timeout); e != nil {
+			return nil, e
+		}
+		resp.RegionError = s.hookRegionError(resp.GetRegionError())
+		return resp.GetRegionError(), nil
+	})
+	if err != nil || retry {
+		return nil, retry, errors.Trace(err)
+	}
+	return
+}
+
+func (s *RegionRequestSender) sendCopReqToRegion(region *Region, req *coprocessor.Request, timeout time.Duration) (resp *coprocessor.Response, retry bool, err error) {
+	retry, err = s.sendToRegion(region, "Cop", req.Size(), false, timeout, func(ctx *kvrpcpb.Context, addr string, timeout time.Duration) (*errorpb.Error, error) {
+		req.Context = ctx
+		var e error
+		if resp, e = s.client.SendCopReq(s.bo.ctx, addr, req, timeout); e != nil {
+			return nil, e
+		}
+		resp.RegionError = s.hookRegionError(resp.GetRegionError())
+		return resp.GetRegionError(), nil
+	})
+	if err != nil || retry {
+		return nil, retry, errors.Trace(err)
+	}
+	return
+}
+
+// attemptTarget is where an attempt of a request goes, see
+// RegionRequestSender.target.
+type attemptTarget struct {
+	storeID   uint64
+	storeAddr string
+	dialAddr  string
+	// circuitOpen is set if the store is kept off by its circuit breaker, so
+	// the attempt moves to the next peer without being sent.
+	circuitOpen bool
+	// limited is set on a dry run if the attempt would wait for the store
+	// limiter.
+	limited bool
+	// release must be called with the result of the attempt, if the store
+	// is acquired from the limiter.
+	release func(ok, busy bool)
+}
+
+// target decides where the next attempt of a request to region goes. Real
+// sends and Route share it, so a dry run resolves the same target as a send.
+// A real send takes the probe of a half-open circuit and waits for the store
+// limiter, while a dry run only reads them and does not update the cache.
+func (s *RegionRequestSender) target(region *Region, size int, isWrite, dryRun bool) (*attemptTarget, error) {
+	if len(region.meta.GetPeers()) == 0 || region.GetAddress() == "" {
+		if dryRun {
+			return nil, errors.Trace(ErrNoPeerAvailable)
+		}
+		log.Warnf("region %d in cache has no available peer", region.GetID())
+		if !s.ReadOnlyCache {
+			s.regionCache.DropRegion(region.VerID())
+		}
+		return nil, errors.Annotatef(ErrNoPeerAvailable, "region %d", region.GetID())
+	}
+	if isWrite && s.MinHealthyReplicas > 0 {
+		if err := s.checkHealthyReplicas(region); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	storeID := region.peer.GetStoreId()
+	t := &attemptTarget{
+		storeID:   storeID,
+		storeAddr: region.GetAddress(),
+		dialAddr:  s.dialAddr(storeID, region.GetAddress()),
+	}
+	if s.cfg.CircuitBreakerFailures > 0 {
+		if dryRun {
+			t.circuitOpen = s.regionCache.circuitOpen(storeID, s.cfg)
+		} else {
+			t.circuitOpen = !s.regionCache.circuitAllow(storeID, s.cfg)
+		}
+		if t.circuitOpen {
+			return t, nil
+		}
+	}
+	if dryRun {
+		t.limited = s.regionCache.storeLimited(storeID, size, s.cfg)
+		return t, nil
+	}
+	release, err := s.acquireStore(storeID, size)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	t.release = release
+	return t, nil
+}
+
+// sendToRegion sends one attempt of a request to the current peer of region
+// by send, which sends the request with ctx to addr and returns the region
+// error of the response. It handles what is the same for KV and coprocessor
+// requests: the target of the attempt, attempt spans and records, and send
+// failures. tp and size are the type and the size of the request, isWrite
+// tells whether a failed send may have applied it.
+func (s *RegionRequestSender) sendToRegion(region *Region, tp string, size int, isWrite bool, timeout time.Duration,
+	send func(ctx *kvrpcpb.Context, addr string, timeout time.Duration) (*errorpb.Error, error)) (retry bool, err error) {
+	t, err := s.target(region, size, isWrite, false)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	ctx := region.GetContext()
+	storeID, addr, release := t.storeID, t.dialAddr, t.release
+	s.storeAddr, s.peerID = t.storeAddr, region.peer.GetId()
+	if t.circuitOpen {
+		if err = s.skipOpenCircuit(region); err != nil {
+			return false, errors.Trace(err)
+		}
+		return true, nil
+	}
+	start := time.Now()
+	span := s.childSpan(SpanAttempt)
+	regionErr, err := send(ctx, addr, s.rpcTimeout(storeID, timeout))
+	release(err == nil, regionErr.GetServerIsBusy() != nil)
+	s.finishAttemptSpan(span, regionErr, err)
+	s.traceEvent(TraceAttempt, start, "")
+	s.recordAttempt(region, start, regionErr, err)
+	if err != nil {
+		if isWrite && !isNotSent(err) {
+			s.maybeApplied = true
+			if s.StrictWriteRetry && s.bo.ctx.Err() == nil {
+				s.traceEvent(TraceSendFail, time.Now(), err.Error())
+				s.reportSendFail(region)
+				return false, errors.Annotatef(ErrResultUndetermined, "send %s to %s: %v", tp, s.storeAddr, err)
+			}
+		}
+		if e := s.onSendFail(region, addr, ctx, err); e != nil {
+			return false, errors.Trace(e)
+		}
+		return true, nil
+	}
+	s.regionCache.reportStoreResult(storeID, time.Since(start), true)
+	if s.cfg.CircuitBreakerFailures > 0 {
+		s.regionCache.reportCircuit(storeID, s.storeAddr, true, s.cfg)
+	}
+	if s.cfg.RecycleConnThreshold > 0 {
+		s.regionCache.resetSendFail(addr)
+	}
+	return false, nil
+}
+
+// hookRegionError returns the region error replaced by RegionErrorHook.
+func (s *RegionRequestSender) hookRegionError(regionErr *errorpb.Error) *errorpb.Error {
+	if s.RegionErrorHook == nil {
+		return regionErr
+	}
+	return s.RegionErrorHook(regionErr)
+}
+
+// takeLastChance tells whether a request failed by err in onRegionError should
+// be sent once more without backoff, see LastChanceRead. Only the errors of
+// exhausted backoff are retried, not the ones of a canceled context.
+func (s *RegionRequestSender) takeLastChance(isRead bool, err error) bool {
+	if !s.LastChanceRead || !isRead || s.lastChanceErr != nil || !strings.Contains(err.Error(), txnRetryableMark) {
+		return false
+	}
+	log.Warnf("backoff is exhausted, send the read request for the last time: %v", err)
+	s.lastChanceErr = err
+	return true
+}
+
+// dialAddr returns the address to send requests to the store.
+func (s *RegionRequestSender) dialAddr(storeID uint64, addr string) string {
+	if s.AddrRewriter == nil {
+		return addr
+	}
+	return s.AddrRewriter(storeID, addr)
+}
+
+// backoff backs off on typ with the backoff set in sender's config, or the
+// default one if it is not set.
+func (s *RegionRequestSender) backoff(typ backoffType, err error) error {
+	if s.lastChanceErr != nil {
+		// The last chance is used up, fail without sleeping.
+		return errors.Trace(s.lastChanceErr)
+	}
+	start := time.Now()
+	if s.trace != nil {
+		s.traceEvent(TraceBackoff, start, fmt.Sprintf("%v: %v", typ, err))
+	}
+	defer func() {
+		s.stats.BackoffTime += time.Since(start)
+		if s.runtimeStats != nil {
+			s.runtimeStats.recordBackoff(typ, time.Since(start))
+		}
+	}()
+	defer s.recordBackoff(start, typ)
+	if span := s.childSpan(SpanBackoff); span != nil {
+		span.SetTag("backoff", typ.String())
+		span.SetTag("reason", err.Error())
+		defer span.Finish()
+	}
+	if c := s.cfg.backoffConfig(typ); c != nil {
+		return errors.Trace(s.bo.backoffWith(typ, c.createFn, c.MaxSleep, err))
+	}
+	return errors.Trace(s.bo.Backoff(typ, err))
+}
+
+// updateReadCache caches the successful response of a point read, or
+// invalidates the cached reads of the keys written by a write request.
+func (s *RegionRequestSender) updateReadCache(region *Region, req *kvrpcpb.Request, resp *kvrpcpb.Response) {
+	if _, isWrite := requestKeys(req); isWrite {
+		s.invalidateReadCache(region.GetID(), req)
+		return
+	}
+	if _, _, ok := cacheableRead(req); ok && s.cfg.readCacheEnabled() {
+		readCacheCounter.WithLabelValues("miss").Inc()
+		s.regionCache.reads.put(region.VerID(), req, resp, s.cfg.ReadCacheTTL, s.cfg.ReadCacheSize)
+	}
+}
+
+// invalidateReadCache invalidates the cached reads of the keys written by a
+// write request. It's called both before sending the write and after it
+// succeeds, so a read that races with the write is not cached for long.
+// Invalidation is done even if the cache is disabled, since it may be filled
+// before it's disabled.
+func (s *RegionRequestSender) invalidateReadCache(regionID uint64, req *kvrpcpb.Request) {
+	if keys, _ := requestKeys(req); keys != nil {
+		s.regionCache.reads.invalidateKeys(keys)
+	} else {
+		s.regionCache.reads.invalidateRegion(regionID)
+	}
+}
+
+// checkHealthyReplicas returns ErrInsufficientReplicas if fewer than
+// MinHealthyReplicas peers of the region are on reachable stores.
+func (s *RegionRequestSender) checkHealthyReplicas(region *Region) error {
+	var healthy int
+	for _, p := range region.meta.GetPeers() {
+		if s.regionCache.StoreReachable(p.GetStoreId()) {
+			healthy++
+		}
+	}
+	if healthy < s.MinHealthyReplicas {
+		return errors.Annotatef(ErrInsufficientReplicas, "region %d has %d healthy replicas, %d required", region.GetID(), healthy, s.MinHealthyReplicas)
+	}
+	return nil
+}
+
+// reportSendFail records a send failure to the current peer of region.
+func (s *RegionRequestSender) reportSendFail(region *Region) {
+	s.stats.SendFail++
+	s.regionCache.reportStoreResult(region.peer.GetStoreId(), 0, false)
+	if s.cfg.CircuitBreakerFailures > 0 {
+		s.regionCache.reportCircuit(region.peer.GetStoreId(), region.GetAddress(), false, s.cfg)
+	}
+}
+
+func (s *RegionRequestSender) onSendFail(region *Region, addr string, ctx *kvrpcpb.Context, err error) error {
+	if s.trace != nil {
+		s.traceEvent(TraceSendFail, time.Now(), err.Error())
+	}
+	// The send is interrupted because the request is canceled, it's not the
+	// store to blame.
+	if e := s.bo.ctx.Err(); e != nil {
+		return errors.Trace(e)
+	}
+	s.reportSendFail(region)
+	if n := s.cfg.RecycleConnThreshold; n > 0 && s.regionCache.addSendFail(addr) >= n {
+		log.Warnf("send to %s failed %d times in a row, recycle connections", addr, n)
+		s.client.RecycleConn(addr)
+		s.regionCache.resetSendFail(addr)
+	}
+	if s.ReadOnlyCache {
+		err = s.backoff(boTiKVRPC, errors.Errorf("send tikv request error: %v, ctx: %s, try again later", err, ctx))
+		return errors.Trace(err)
+	}
+	s.regionCache.NextPeer(region.VerID())
+	s.meta.TouchedPD = true
+	err = s.backoff(boTiKVRPC, errors.Errorf("send tikv request error: %v, ctx: %s, try next peer later", err, ctx))
+	return errors.Trace(err)
+}
+
+func (s *RegionRequestSender) onRegionError(region *Region, regionErr *errorpb.Error) (retry bool, err error) {
+	s.lastRegionErr = regionErr
+	reportRegionError(regionErr)
+	s.regionCache.recordRegionError(regionErr, region.GetID(), s.storeAddr)
+	if s.trace != nil {
+		s.traceEvent(TraceRegionError, time.Now(), regionErr.String())
+	}
+	ctx := region.GetContext()
+	if regionErr.GetNotLeader() != nil || regionErr.GetStaleEpoch() != nil {
+		s.regionCache.reads.invalidateRegion(region.GetID())
+	}
+	if s.ReadOnlyCache && regionErr.GetServerIsBusy() == nil {
+		log.Warnf("tikv reports region error: %s, ctx: %s, cache is read-only", regionErr, ctx)
+		return false, nil
+	}
+	if notLeader := regionErr.GetNotLeader(); notLeader != nil {
+		// Retry if error is `NotLeader`.
+		s.stats.NotLeader++
+		if leader := notLeader.GetLeader(); leader != nil && !regionHasPeer(region, leader.GetId()) {
+			// The leader is a peer added after the region is cached. Reload
+			// the region for the new peer instead of retrying the old ones.
+			log.Warnf("tikv reports `NotLeader`: %s, ctx: %s, leader is not in cache, reload region", notLeader, ctx)
+			s.regionCache.DropRegion(region.VerID())
+			reloaded, loaded, err := s.regionCache.getRegion(s.bo, region.StartKey())
+			s.meta.TouchedPD = s.meta.TouchedPD || loaded
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if !regionHasPeer(reloaded, leader.GetId()) {
+				// PD does not know the new peer yet. Drop the region again
+				// so the request bounces back to caller, which backs off,
+				// instead of reloading it in a loop.
+				log.Warnf("region %d reloaded from PD has no peer %d yet", reloaded.GetID(), leader.GetId())
+				s.regionCache.DropRegion(reloaded.VerID())
+			}
+			return true, nil
+		}
+		if w := s.cfg.NotLeaderDampenWindow; w > 0 && notLeader.GetLeader() != nil && s.regionCache.DampenNotLeader(region.VerID(), w) {
+			log.Warnf("tikv reports `NotLeader`: %s, ctx: %s, retry cached leader", notLeader, ctx)
+			return true, nil
+		}
+		if leader := notLeader.GetLeader(); leader != nil && s.peerCircuitOpen(region, leader.GetId()) {
+			// Switching to the leader would only skip it again.
+			log.Warnf("tikv reports `NotLeader`: %s, ctx: %s, circuit breaker of the leader is open, retry later", notLeader, ctx)
+			err = s.backoff(boRegionMiss, errors.Errorf("not leader: %v, ctx: %s, circuit breaker of the leader is open", notLeader, ctx))
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			return true, nil
+		}
+		log.Warnf("tikv reports `NotLeader`: %s, ctx: %s, retry later", notLeader, ctx)
+		s.regionCache.UpdateLeader(region.VerID(), notLeader.GetLeader().GetId())
+		s.meta.TouchedPD = true
+		if notLeader.GetLeader() == nil {
+			err = s.backoff(boRegionMiss, errors.Errorf("not leader: %v, ctx: %s", notLeader, ctx))
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+		}
+		return true, nil
+	}
+
+	// The peer may be removed from the store, for example, during region
+	// balance. Remove the peer from cache and try other peers.
+	if regionErr.GetRegionNotFound() != nil && len(region.meta.GetPeers()) > 1 {
+		log.Warnf("tikv reports `RegionNotFound`, ctx: %s, try next peer later", ctx)
+		s.regionCache.RemovePeer(region.VerID(), region.peer.GetId())
+		s.meta.TouchedPD = true
+		return true, nil
+	}
+
+	if staleEpoch := regionErr.GetStaleEpoch(); staleEpoch != nil {
+		log.Warnf("tikv reports `StaleEpoch`, ctx: %s, retry later", ctx)
+		s.stats.StaleEpoch++
+		err = s.regionCache.OnRegionStale(region, staleEpoch.NewRegions)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if err = s.staggerRedispatch(); err != nil {
+			return false, errors.Trace(err)
+		}
+		return true, nil
+	}
+
+	// Retry if the error is `ServerIsBusy`.
+	if regionErr.GetServerIsBusy() != nil {
+		log.Warnf("tikv reports `ServerIsBusy`, ctx: %s, retry later", ctx)
+		s.stats.ServerBusy++
+		s.regionCache.reportStoreBusy(region.peer.GetStoreId())
+		err = s.backoff(boServerBusy, errors.Errorf("server is busy, ctx: %s", ctx))
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		return true, nil
+	}
+
+	// The region is not found on its only peer, or the keys are out of the
+	// region. We only drop cache here, because caller may need to re-split
+	// the request. Back off first, so a region that keeps failing does
+	// not hot loop PD and tikv.
+	if regionErr.GetRegionNotFound() == nil && regionErr.GetKeyNotInRegion() == nil {
+		// Errors without a known type, such as a raft entry being too large,
+		// won't be fixed by retrying.
+		log.Warnf("tikv reports unknown region error: %s, ctx: %s", regionErr, ctx)
+		s.regionCache.DropRegion(region.VerID())
+		return false, errors.Annotatef(ErrUnknownRegionError, "%s, ctx: %s", regionErr, ctx)
+	}
+	log.Warnf("tikv reports region error: %s, ctx: %s, retry later", regionErr, ctx)
+	s.regionCache.DropRegion(region.VerID())
+	err = s.backoff(boRegionMiss, errors.Errorf("region error: %s, ctx: %s", regionErr, ctx))
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if s.InlineReloadOnDrop {
+		// If the reloaded region has the same version, the next retry finds
+		// it in cache and sends again. Otherwise the request returns a
+		// `StaleEpoch` error and leaves the re-split to caller.
+		_, loaded, err := s.regionCache.getRegion(s.bo, region.StartKey())
+		s.meta.TouchedPD = s.meta.TouchedPD || loaded
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if err = s.staggerRedispatch(); err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+	return true, nil
+}
+
+// checkRetryBudget returns ErrRetryExhausted if the request has used up
+// MaxRetries or MaxRetryTime.
+func (s *RegionRequestSender) checkRetryBudget() error {
+	if s.MaxRetries > 0 && s.retries > s.MaxRetries {
+		return errors.Annotatef(ErrRetryExhausted, "retried %d times, last region error: %v", s.MaxRetries, s.lastRegionErr)
+	}
+	if s.MaxRetryTime > 0 && s.retries > 0 {
+		if d := time.Since(s.start); d > s.MaxRetryTime {
+			return errors.Annotatef(ErrRetryExhausted, "retried %d times in %v, last region error: %v", s.retries, d, s.lastRegionErr)
+		}
+	}
+	return nil
+}
+
+func regionHasPeer(region *Region, peerID uint64) bool {
+	for _, p := range region.meta.GetPeers() {
+		if p.GetId() == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// staggerRedispatch sleeps a random time within SenderConfig.ReloadStagger
+// before a request is sent again to a reloaded region. Unlike backoff, it
+// does not count in the Backoffer's total sleep.
+func (s *RegionRequestSender) staggerRedispatch() error {
+	w := s.cfg.ReloadStagger
+	if w <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(w)))):
+		return nil
+	case <-s.bo.ctx.Done():
+		return errors.Trace(s.bo.ctx.Err())
+	}
+}
+
+// reloadOnCacheMiss reloads the region of the request as CacheMissPolicy says.
+// It returns nil if the request should not be retried inline.
+func (s *RegionRequestSender) reloadOnCacheMiss(req *kvrpcpb.Request) (*Region, error) {
+	if s.ReadOnlyCache || s.CacheMissPolicy == CacheMissStaleEpoch {
+		return nil, nil
+	}
+	if _, isWrite := requestKeys(req); !isWrite && s.CacheMissPolicy != CacheMissReload {
+		return nil, nil
+	}
+	region, err := s.loadRegionOfKeys(req)
+	return region, errors.Trace(err)
+}
+
+// loadRegionOfKeys returns the region of the keys of req, loading it from PD
+// if it's not cached. It returns nil if req has no key or the keys are in
+// different regions now, so caller has to split the request.
+func (s *RegionRequestSender) loadRegionOfKeys(req *kvrpcpb.Request) (*Region, error) {
+	keys, _ := requestKeys(req)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	region, loaded, err := s.regionCache.getRegion(s.bo, keys[0])
+	s.meta.TouchedPD = s.meta.TouchedPD || loaded
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !regionContainsKeys(region, req) {
+		return nil, nil
+	}
+	return region, nil
+}
+
+// regionContainsKeys checks the keys of req against the range of region. Keys
+// in cache are decoded by the codec of PD client, so they are comparable with
+// the keys of req. Requests without keys, such as Scan, always pass.
+func regionContainsKeys(region *Region, req *kvrpcpb.Request) bool {
+	keys, _ := requestKeys(req)
+	for _, k := range keys {
+		if !region.Contains(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// leaderProbe returns a read request on the first key of req to confirm the
+// leader before sending req, or nil if it is not needed. See
+// ConfirmLeaderMinSize.
+func (s *RegionRequestSender) leaderProbe(region *Region, req *kvrpcpb.Request) *kvrpcpb.Request {
+	if s.ConfirmLeaderMinSize <= 0 || s.ReadOnlyCache || region.leaderConfirmed {
+		return nil
+	}
+	keys, isWrite := requestKeys(req)
+	if !isWrite || len(keys) == 0 || proto.Size(req) < s.ConfirmLeaderMinSize {
+		return nil
+	}
+	return &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: keys[0],
+		},
+	}
+}
+
+// requestKeys returns the keys of a request, or nil if the request is on a
+// key range. isWrite tells whether the request modifies data.
+func requestKeys(req *kvrpcpb.Request) (keys [][]byte, isWrite bool) {
+	switch req.GetType() {
+	case kvrpcpb.MessageType_CmdGet:
+		return [][]byte{req.GetCmdGetReq().GetKey()}, false
+	case kvrpcpb.MessageType_CmdBatchGet:
+		return req.GetCmdBatchGetReq().GetKeys(), false
+	case kvrpcpb.MessageType_CmdRawGet:
+		return [][]byte{req.GetCmdRawGetReq().GetKey()}, false
+	case kvrpcpb.MessageType_CmdPrewrite:
+		for _, m := range req.GetCmdPrewriteReq().GetMutations() {
+			keys = append(keys, m.GetKey())
+		}
+		return keys, true
+	case kvrpcpb.MessageType_CmdCommit:
+		return req.GetCmdCommitReq().GetKeys(), true
+	case kvrpcpb.MessageType_CmdCleanup:
+		return [][]byte{req.GetCmdCleanupReq().GetKey()}, true
+	case kvrpcpb.MessageType_CmdBatchRollback:
+		return req.GetCmdBatchRollbackReq().GetKeys(), true
+	case kvrpcpb.MessageType_CmdRawPut:
+		return [][]byte{req.GetCmdRawPutReq().GetKey()}, true
+	case kvrpcpb.MessageType_CmdRawDelete:
+		return [][]byte{req.GetCmdRawDeleteReq().GetKey()}, true
+	case kvrpcpb.MessageType_CmdResolveLock, kvrpcpb.MessageType_CmdGC:
+		return nil, true
+	}
+	return nil, false
+}
+
+// validateKVRequest checks that the body required by the request's type is set.
+func validateKVRequest(req *kvrpcpb.Request) error {
+	var ok bool
+	switch req.GetType() {
+	case kvrpcpb.MessageType_CmdGet:
+		ok = len(req.GetCmdGetReq().GetKey()) > 0
+	case kvrpcpb.MessageType_CmdScan:
+		ok = req.GetCmdScanReq() != nil
+	case kvrpcpb.MessageType_CmdPrewrite:
+		ok = len(req.GetCmdPrewriteReq().GetMutations()) > 0
+	case kvrpcpb.MessageType_CmdCommit:
+		ok = len(req.GetCmdCommitReq().GetKeys()) > 0
+	case kvrpcpb.MessageType_CmdCleanup:
+		ok = len(req.GetCmdCleanupReq().GetKey()) > 0
+	case kvrpcpb.MessageType_CmdBatchGet:
+		ok = len(req.GetCmdBatchGetReq().GetKeys()) > 0
+	case kvrpcpb.MessageType_CmdBatchRollback:
+		ok = len(req.GetCmdBatchRollbackReq().GetKeys()) > 0
+	case kvrpcpb.MessageType_CmdScanLock:
+		ok = req.GetCmdScanLockReq() != nil
+	case kvrpcpb.MessageType_CmdResolveLock:
+		ok = req.GetCmdResolveLockReq() != nil
+	case kvrpcpb.MessageType_CmdGC:
+		ok = req.GetCmdGcReq() != nil
+	case kvrpcpb.MessageType_CmdRawGet:
+		ok = len(req.GetCmdRawGetReq().GetKey()) > 0
+	case kvrpcpb.MessageType_CmdRawPut:
+		ok = len(req.GetCmdRawPutReq().GetKey()) > 0
+	case kvrpcpb.MessageType_CmdRawDelete:
+		ok = len(req.GetCmdRawDeleteReq().GetKey()) > 0
+	}
+	if !ok {
+		return errors.Annotatef(ErrInvalidRequest, "missing body for %s", req.GetType())
+	}
+	return nil
+}
+
+// validateCopRequest checks that the coprocessor request has data and ranges.
+func validateCopRequest(req *coprocessor.Request) error {
+	if len(req.GetData()) == 0 || len(req.GetRanges()) == 0 {
+		return errors.Annotatef(ErrInvalidRequest, "coprocessor request tp %d has no data or ranges", req.GetTp())
+	}
+	return nil
+}
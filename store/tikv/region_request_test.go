@@ -0,0 +1,2097 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/store/tikv/mock-tikv"
+	"github.com/pingcap/tidb/terror"
+	"golang.org/x/net/context"
+)
+
+type testRegionRequestSuite struct {
+	cluster *mocktikv.Cluster
+	store   uint64
+	peer    uint64
+	region  uint64
+	cache   *RegionCache
+	client  *mocktikv.RPCClient
+	bo      *Backoffer
+}
+
+var _ = Suite(&testRegionRequestSuite{})
+
+func (s *testRegionRequestSuite) SetUpTest(c *C) {
+	s.cluster = mocktikv.NewCluster()
+	s.store, s.peer, s.region = mocktikv.BootstrapWithSingleStore(s.cluster)
+	pdCli := &codecPDClient{mocktikv.NewPDClient(s.cluster)}
+	s.cache = NewRegionCache(pdCli)
+	s.client = mocktikv.NewRPCClient(s.cluster, mocktikv.NewMvccStore())
+	s.bo = NewBackoffer(5000, context.Background())
+}
+
+func (s *testRegionRequestSuite) newSender() *RegionRequestSender {
+	return NewRegionRequestSender(s.bo, s.cache, s.client)
+}
+
+func (s *testRegionRequestSuite) TestSendKVReq(c *C) {
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{
+			Key:   []byte("key"),
+			Value: []byte("value"),
+		},
+	}
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	sender := s.newSender()
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError(), IsNil)
+	c.Assert(resp.GetCmdRawPutResp(), NotNil)
+
+	// Requests are numbered in issue order.
+	seq := sender.Meta().Seq
+	c.Assert(seq, Greater, uint64(0))
+	sender = s.newSender()
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().Seq, Equals, seq+1)
+}
+
+func (s *testRegionRequestSuite) TestResultMetaApproximateSize(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	s.cache.UpdateApproximateSize(s.region, 4096, 20)
+	req := &coprocessor.Request{
+		Tp:   kv.ReqTypeSelect,
+		Data: []byte("data"),
+	}
+	sender := s.newSender()
+	_, err = sender.SendCopReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().ApproximateSize, Equals, uint64(4096))
+	c.Assert(sender.Meta().ApproximateKeys, Equals, uint64(20))
+}
+
+func (s *testRegionRequestSuite) TestSendKVReqStaleRegion(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	s.cache.DropRegion(region.VerID())
+
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	resp, err := s.newSender().SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+}
+
+func (s *testRegionRequestSuite) TestCacheMissPolicy(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	putReq := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{
+			Key:   []byte("key"),
+			Value: []byte("value"),
+		},
+	}
+	getReq := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+
+	// Default policy bounces the write.
+	s.cache.DropRegion(region.VerID())
+	resp, err := s.newSender().SendKVReq(putReq, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+
+	sender := s.newSender()
+	sender.CacheMissPolicy = CacheMissReloadWrites
+	resp, err = sender.SendKVReq(putReq, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError(), IsNil)
+	c.Assert(resp.GetCmdRawPutResp(), NotNil)
+
+	s.cache.DropRegion(region.VerID())
+	sender = s.newSender()
+	sender.CacheMissPolicy = CacheMissReloadWrites
+	resp, err = sender.SendKVReq(getReq, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+
+	sender = s.newSender()
+	sender.CacheMissPolicy = CacheMissReload
+	resp, err = sender.SendKVReq(getReq, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetCmdRawGetResp().GetValue(), BytesEquals, []byte("value"))
+}
+
+func (s *testRegionRequestSuite) TestRequestValidation(c *C) {
+	SetRequestValidation(true)
+	defer SetRequestValidation(false)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	sender := s.newSender()
+
+	req := &kvrpcpb.Request{Type: kvrpcpb.MessageType_CmdRawGet}
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrInvalidRequest)
+
+	copReq := &coprocessor.Request{Tp: 101}
+	_, err = sender.SendCopReq(copReq, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrInvalidRequest)
+
+	req = &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+}
+
+func (s *testRegionRequestSuite) TestInlineReloadOnDrop(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &regionErrClient{Client: s.client}
+
+	// By default, the dropped region bounces back to caller.
+	client.errs = []*errorpb.Error{{KeyNotInRegion: &errorpb.KeyNotInRegion{}}}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+
+	region, err = s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	client.errs = []*errorpb.Error{{KeyNotInRegion: &errorpb.KeyNotInRegion{}}}
+	sender = NewRegionRequestSender(s.bo, s.cache, client)
+	sender.InlineReloadOnDrop = true
+	resp, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError(), IsNil)
+	c.Assert(resp.GetCmdRawGetResp(), NotNil)
+}
+
+func (s *testRegionRequestSuite) TestAudit(c *C) {
+	sink := &testAuditSink{}
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &regionErrClient{
+		Client: s.client,
+		errs:   []*errorpb.Error{s.notLeaderErr()},
+	}
+	bo := NewBackoffer(5000, WithAuditPrincipal(context.Background(), "alice"))
+	sender := NewRegionRequestSender(bo, s.cache, client)
+	sender.AuditSink = sink
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sink.records, HasLen, 1)
+	r := sink.records[0]
+	c.Assert(r.Principal, Equals, "alice")
+	c.Assert(r.Type, Equals, kvrpcpb.MessageType_CmdRawGet.String())
+	c.Assert(r.RegionID, Equals, s.region)
+	c.Assert(r.StoreAddr, Equals, region.GetAddress())
+	c.Assert(r.Retries, Equals, 1)
+	c.Assert(r.Outcome, Equals, AuditSuccess)
+}
+
+func (s *testRegionRequestSuite) TestNoPeerAvailable(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	// Make the cached region malformed.
+	s.cache.mu.regions[region.VerID()].addr = ""
+
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	_, err = s.newSender().SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrNoPeerAvailable)
+	c.Assert(s.cache.GetRegionByVerID(region.VerID()), IsNil)
+
+	// The region is reloaded next time.
+	region, err = s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	c.Assert(region.GetAddress(), Not(Equals), "")
+}
+
+func (s *testRegionRequestSuite) TestReadOnlyCache(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &regionErrClient{
+		Client: s.client,
+		errs:   []*errorpb.Error{{Message: proto.String("unknown")}},
+	}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	sender.ReadOnlyCache = true
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetMessage(), Equals, "unknown")
+	// The region is not dropped.
+	c.Assert(s.cache.GetRegionByVerID(region.VerID()), NotNil)
+}
+
+func (s *testRegionRequestSuite) TestTimeline(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{
+		ServerBusyBackoff: &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter},
+	})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &regionErrClient{
+		Client: s.client,
+		errs:   []*errorpb.Error{{ServerIsBusy: &errorpb.ServerIsBusy{}}},
+	}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Timeline(), HasLen, 0)
+
+	client.errs = []*errorpb.Error{{ServerIsBusy: &errorpb.ServerIsBusy{}}}
+	sender = NewRegionRequestSender(s.bo, s.cache, client)
+	sender.RecordTimeline = true
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	timeline := sender.Timeline()
+	c.Assert(timeline, HasLen, 3)
+	c.Assert(timeline[0].Kind, Equals, SegmentAttempt)
+	c.Assert(timeline[0].Outcome, Equals, "server_is_busy")
+	c.Assert(timeline[0].StoreAddr, Equals, region.GetAddress())
+	c.Assert(timeline[1].Kind, Equals, SegmentBackoff)
+	c.Assert(timeline[1].Outcome, Equals, boServerBusy.String())
+	c.Assert(timeline[2].Kind, Equals, SegmentAttempt)
+	c.Assert(timeline[2].Outcome, Equals, "success")
+	for i, seg := range timeline {
+		c.Assert(seg.End.Before(seg.Start), IsFalse)
+		if i > 0 {
+			c.Assert(seg.Start.Before(timeline[i-1].End), IsFalse)
+		}
+	}
+}
+
+func (s *testRegionRequestSuite) TestReconfigureSender(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &regionErrClient{Client: s.client}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+
+	ReconfigureSender(SenderConfig{
+		MinRPCTimeout:     time.Minute,
+		ServerBusyBackoff: &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter},
+	})
+	// The running sender keeps its config.
+	_, err = sender.SendKVReq(req, region.VerID(), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, time.Second)
+
+	client.errs = []*errorpb.Error{{ServerIsBusy: &errorpb.ServerIsBusy{}}}
+	bo := NewBackoffer(5000, context.Background())
+	_, err = NewRegionRequestSender(bo, s.cache, client).SendKVReq(req, region.VerID(), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, time.Minute)
+	c.Assert(bo.totalSleep, Equals, 1)
+}
+
+func (s *testRegionRequestSuite) TestReconfigureCacheSender(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &regionErrClient{Client: s.client}
+	other := NewRegionCache(&codecPDClient{mocktikv.NewPDClient(s.cluster)})
+	s.cache.ReconfigureSender(SenderConfig{MinRPCTimeout: time.Minute})
+	c.Assert(s.cache.CurrentSenderConfig().MinRPCTimeout, Equals, time.Minute)
+	c.Assert(other.CurrentSenderConfig().MinRPCTimeout, Equals, CurrentSenderConfig().MinRPCTimeout)
+
+	// Only the senders of the reconfigured cache use its config.
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	_, err = sender.SendKVReq(req, region.VerID(), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, time.Minute)
+	otherRegion, err := other.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	_, err = NewRegionRequestSender(s.bo, other, client).SendKVReq(req, otherRegion.VerID(), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, time.Second)
+
+	// The config of a sender overrides the one of its cache.
+	sender.Reconfigure(SenderConfig{MinRPCTimeout: 2 * time.Minute})
+	_, err = sender.SendKVReq(req, region.VerID(), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, 2*time.Minute)
+}
+
+type recordClient struct {
+	Client
+	sent []string
+}
+
+func (c *recordClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	c.sent = append(c.sent, fmt.Sprintf("%s@%s", req.GetType(), addr))
+	return c.Client.SendKVReq(ctx, addr, req, timeout)
+}
+
+func (s *testRegionRequestSuite) TestConfirmLeader(c *C) {
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	s.cluster.AddPeer(s.region, storeID, peerID)
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	leaderAddr := region.GetAddress()
+	// Cached leader is wrong.
+	s.cache.UpdateLeader(region.VerID(), peerID)
+
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{
+			Key:   []byte("key"),
+			Value: make([]byte, 1024),
+		},
+	}
+	client := &recordClient{Client: s.client}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	sender.ConfirmLeaderMinSize = 512
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetCmdRawPutResp(), NotNil)
+	rawGet, rawPut := kvrpcpb.MessageType_CmdRawGet, kvrpcpb.MessageType_CmdRawPut
+	followerAddr := fmt.Sprintf("store%d", storeID)
+	c.Assert(client.sent, DeepEquals, []string{
+		fmt.Sprintf("%s@%s", rawGet, followerAddr),
+		fmt.Sprintf("%s@%s", rawGet, leaderAddr),
+		fmt.Sprintf("%s@%s", rawPut, leaderAddr),
+	})
+
+	// The leader is confirmed.
+	client.sent = nil
+	sender = NewRegionRequestSender(s.bo, s.cache, client)
+	sender.ConfirmLeaderMinSize = 512
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(client.sent, DeepEquals, []string{fmt.Sprintf("%s@%s", rawPut, leaderAddr)})
+}
+
+func (s *testRegionRequestSuite) TestDampenNotLeader(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{NotLeaderDampenWindow: time.Minute})
+
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	s.cluster.AddPeer(s.region, storeID, peerID)
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	blip := &errorpb.Error{NotLeader: &errorpb.NotLeader{
+		RegionId: proto.Uint64(s.region),
+		Leader:   &metapb.Peer{Id: peerID, StoreId: storeID},
+	}}
+	client := &recordClient{Client: &regionErrClient{Client: s.client, errs: []*errorpb.Error{blip}}}
+	_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	// The cached leader is retried and kept.
+	c.Assert(client.sent, DeepEquals, []string{
+		fmt.Sprintf("%s@%s", req.GetType(), region.GetAddress()),
+		fmt.Sprintf("%s@%s", req.GetType(), region.GetAddress()),
+	})
+	c.Assert(s.cache.GetRegionByVerID(region.VerID()).peer.GetId(), Equals, s.peer)
+
+	// The second `NotLeader` in window is not dampened.
+	c.Assert(s.cache.DampenNotLeader(region.VerID(), time.Minute), IsFalse)
+	c.Assert(s.cache.DampenNotLeader(region.VerID(), time.Minute), IsTrue)
+	c.Assert(s.cache.DampenNotLeader(region.VerID(), 0), IsTrue)
+}
+
+func (s *testRegionRequestSuite) TestAttemptedPeers(c *C) {
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	s.cluster.AddPeer(s.region, storeID, peerID)
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	leaderAddr := region.GetAddress()
+	s.cache.UpdateLeader(region.VerID(), peerID)
+
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	sender := s.newSender()
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.AttemptedPeers(), DeepEquals, []PeerAttempt{
+		{PeerID: peerID, StoreID: storeID, StoreAddr: fmt.Sprintf("store%d", storeID), Role: RoleFollower, Outcome: "not_leader"},
+		{PeerID: s.peer, StoreID: s.store, StoreAddr: leaderAddr, Role: RoleLeader, Outcome: "success"},
+	})
+}
+
+func (s *testRegionRequestSuite) TestRegionNotFoundOnPeer(c *C) {
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	s.cluster.AddPeer(s.region, storeID, peerID)
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	s.cache.UpdateLeader(region.VerID(), peerID)
+
+	client := &regionErrClient{
+		Client: s.client,
+		errs:   []*errorpb.Error{{RegionNotFound: &errorpb.RegionNotFound{RegionId: proto.Uint64(s.region)}}},
+	}
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	resp, err := NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError(), IsNil)
+	region = s.cache.GetRegionByVerID(region.VerID())
+	c.Assert(region.meta.GetPeers(), HasLen, 1)
+	c.Assert(region.peer.GetId(), Equals, s.peer)
+}
+
+func (s *testRegionRequestSuite) TestResponseProcessors(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &regionErrClient{
+		Client: s.client,
+		errs:   []*errorpb.Error{s.notLeaderErr()},
+	}
+	var calls []string
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	sender.ResponseProcessors = []ResponseProcessor{
+		func(req *kvrpcpb.Request, resp *kvrpcpb.Response) (*kvrpcpb.Response, error) {
+			c.Assert(resp.GetRegionError(), IsNil)
+			calls = append(calls, "first")
+			resp.CmdRawGetResp.Value = []byte("processed")
+			return resp, nil
+		},
+		func(req *kvrpcpb.Request, resp *kvrpcpb.Response) (*kvrpcpb.Response, error) {
+			calls = append(calls, "second")
+			c.Assert(resp.GetCmdRawGetResp().GetValue(), BytesEquals, []byte("processed"))
+			return resp, nil
+		},
+	}
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(calls, DeepEquals, []string{"first", "second"})
+	c.Assert(resp.GetCmdRawGetResp().GetValue(), BytesEquals, []byte("processed"))
+
+	sender = s.newSender()
+	sender.ResponseProcessors = []ResponseProcessor{
+		func(req *kvrpcpb.Request, resp *kvrpcpb.Response) (*kvrpcpb.Response, error) {
+			return nil, errors.New("processor failed")
+		},
+	}
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, NotNil)
+}
+
+func (s *testRegionRequestSuite) TestRequestTrace(c *C) {
+	dir, err := ioutil.TempDir("", "tikv-trace")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.log")
+	c.Assert(EnableRequestTrace(path, 0), IsNil)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &regionErrClient{
+		Client: s.client,
+		errs:   []*errorpb.Error{s.notLeaderErr()},
+	}
+	_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	DisableRequestTrace()
+
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	var traces []*RequestTrace
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		t := &RequestTrace{}
+		c.Assert(json.Unmarshal(scanner.Bytes(), t), IsNil)
+		traces = append(traces, t)
+	}
+	c.Assert(traces, HasLen, 1)
+	t := traces[0]
+	c.Assert(t.Type, Equals, kvrpcpb.MessageType_CmdRawGet.String())
+	c.Assert(t.RegionID, Equals, s.region)
+	c.Assert(t.Outcome, Equals, AuditSuccess)
+	var kinds []string
+	for _, e := range t.Events {
+		kinds = append(kinds, e.Kind)
+	}
+	c.Assert(kinds, DeepEquals, []string{TraceAttempt, TraceRegionError, TraceAttempt})
+	c.Assert(t.Events[2].StoreAddr, Equals, region.GetAddress())
+
+	// Trace is disabled.
+	_, err = s.newSender().SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, string(mustMarshalTrace(c, t)))
+}
+
+func (s *testRegionRequestSuite) TestRequestTraceRotate(c *C) {
+	dir, err := ioutil.TempDir("", "tikv-trace")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.log")
+	c.Assert(EnableRequestTrace(path, 1), IsNil)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	for i := 0; i < 2; i++ {
+		_, err = s.newSender().SendKVReq(req, region.VerID(), readTimeoutShort)
+		c.Assert(err, IsNil)
+	}
+	DisableRequestTrace()
+
+	_, err = os.Stat(path)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(path + ".1")
+	c.Assert(err, IsNil)
+}
+
+func mustMarshalTrace(c *C, t *RequestTrace) []byte {
+	data, err := json.Marshal(t)
+	c.Assert(err, IsNil)
+	return append(data, '\n')
+}
+
+type sendFailClient struct {
+	Client
+	recycled []string
+}
+
+func (c *sendFailClient) RecycleConn(addr string) {
+	c.recycled = append(c.recycled, addr)
+}
+
+func (c *sendFailClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	return nil, errors.New("connection reset")
+}
+
+func (s *testRegionRequestSuite) TestRecycleConn(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{
+		TiKVRPCBackoff:       &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter},
+		RecycleConnThreshold: 2,
+	})
+
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &sendFailClient{Client: s.client}
+	for i := 0; i < 4; i++ {
+		region, err := s.cache.GetRegion(s.bo, []byte("key"))
+		c.Assert(err, IsNil)
+		// The region is dropped after failure since it has only one peer.
+		resp, err := NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+		c.Assert(err, IsNil)
+		c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+	}
+	c.Assert(s.cache.getRegionFromCache([]byte("key")), IsNil)
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	c.Assert(client.recycled, DeepEquals, []string{region.GetAddress(), region.GetAddress()})
+
+	// Success resets the count.
+	_, err = NewRegionRequestSender(s.bo, s.cache, client.Client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	region, err = s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(client.recycled, HasLen, 2)
+}
+
+func (s *testRegionRequestSuite) TestRetryAdvice(c *C) {
+	SetRequestValidation(true)
+	defer SetRequestValidation(false)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	_, err = s.newSender().SendKVReq(&kvrpcpb.Request{Type: kvrpcpb.MessageType_CmdRawPut}, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrInvalidRequest)
+	advice, ok := RetryAdvice(errors.Trace(err))
+	c.Assert(ok, IsTrue)
+	c.Assert(advice.Retryable, IsFalse)
+	c.Assert(advice.Effect, Equals, EffectNotApplied)
+
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{
+			Key:   []byte("key"),
+			Value: []byte("value"),
+		},
+	}
+	bo := NewBackoffer(1, context.Background())
+	sender := NewRegionRequestSender(bo, s.cache, &sendFailClient{Client: s.client})
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, NotNil)
+	advice, ok = RetryAdvice(errors.Trace(err))
+	c.Assert(ok, IsTrue)
+	c.Assert(advice.Retryable, IsTrue)
+	c.Assert(advice.Delay > 0, IsTrue)
+	c.Assert(advice.Effect, Equals, EffectUnknown)
+
+	// A read sent by the same sender later is not affected by the write.
+	region, err = s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req = &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("key")},
+	}
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, NotNil)
+	advice, ok = RetryAdvice(errors.Trace(err))
+	c.Assert(ok, IsTrue)
+	c.Assert(advice.Effect, Equals, EffectNotApplied)
+
+	_, ok = RetryAdvice(errors.New("other"))
+	c.Assert(ok, IsFalse)
+}
+
+type proxyClient struct {
+	Client
+	dialed []string
+}
+
+func (c *proxyClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	c.dialed = append(c.dialed, addr)
+	if !strings.HasPrefix(addr, "proxy/") {
+		return nil, errors.New("connect fail")
+	}
+	return c.Client.SendKVReq(ctx, strings.TrimPrefix(addr, "proxy/"), req, timeout)
+}
+
+func (s *testRegionRequestSuite) TestAddrRewriter(c *C) {
+	sink := &testAuditSink{}
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{
+			Key: []byte("key"),
+		},
+	}
+	client := &proxyClient{Client: s.client}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	sender.AuditSink = sink
+	sender.AddrRewriter = func(storeID uint64, addr string) string {
+		c.Assert(storeID, Equals, s.store)
+		return "proxy/" + addr
+	}
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError(), IsNil)
+	c.Assert(client.dialed, DeepEquals, []string{"proxy/" + region.GetAddress()})
+	c.Assert(sink.records, HasLen, 1)
+	c.Assert(sink.records[0].StoreAddr, Equals, region.GetAddress())
+}
+
+func (s *testRegionRequestSuite) TestAddrRewriterProbe(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	cfg := SenderConfig{
+		CircuitBreakerFailures:        1,
+		CircuitBreakerCooldown:        time.Millisecond,
+		CircuitBreakerBackgroundProbe: true,
+	}
+	ReconfigureSender(cfg)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	addr := region.GetAddress()
+	s.cache.reportCircuit(s.store, addr, false, &cfg)
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitHalfOpen)
+
+	// The probe dials the proxy, and closes the circuit of the store.
+	client := &proxyClient{Client: s.client}
+	sweeper := NewHealthSweeper(s.cache, client, HealthSweepConfig{
+		Interval: time.Hour,
+		AddrRewriter: func(storeID uint64, addr string) string {
+			return "proxy/" + addr
+		},
+	})
+	defer sweeper.Close()
+	sweeper.probe(s.store)
+	c.Assert(client.dialed, DeepEquals, []string{"proxy/" + addr})
+	c.Assert(s.cache.StoreReachable(s.store), IsTrue)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitClosed)
+}
+
+// circuitStatus returns the status of the circuit breaker of the store.
+func (s *testRegionRequestSuite) circuitStatus(storeID uint64) CircuitStatus {
+	for _, state := range s.cache.CircuitStates() {
+		if state.StoreID == storeID {
+			return state.Status
+		}
+	}
+	return CircuitClosed
+}
+
+// notLeaderErr returns a `NotLeader` error that points to the current leader,
+// so the sender retries without backoff.
+func (s *testRegionRequestSuite) notLeaderErr() *errorpb.Error {
+	return &errorpb.Error{
+		NotLeader: &errorpb.NotLeader{
+			RegionId: proto.Uint64(s.region),
+			Leader:   &metapb.Peer{Id: s.peer, StoreId: s.store},
+		},
+	}
+}
+
+type testAuditSink struct {
+	records []*AuditRecord
+}
+
+func (s *testAuditSink) Record(r *AuditRecord) {
+	s.records = append(s.records, r)
+}
+
+func (s *testRegionRequestSuite) TestBufferedAuditSink(c *C) {
+	sink := &testAuditSink{}
+	buffered := NewBufferedAuditSink(sink, 10)
+	for i := 0; i < 3; i++ {
+		buffered.Record(&AuditRecord{Retries: i})
+	}
+	// Close forwards the buffered records before it returns.
+	buffered.Close()
+	c.Assert(sink.records, HasLen, 3)
+	c.Assert(buffered.Dropped(), Equals, uint64(0))
+
+	buffered.Record(&AuditRecord{})
+	c.Assert(buffered.Dropped(), Equals, uint64(1))
+	c.Assert(sink.records, HasLen, 3)
+	buffered.Close()
+}
+
+// regionErrClient returns the queued region errors before forwarding
+// requests to the wrapped Client.
+type regionErrClient struct {
+	Client
+	errs        []*errorpb.Error
+	lastTimeout time.Duration
+}
+
+func (c *regionErrClient) next() *errorpb.Error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	e := c.errs[0]
+	c.errs = c.errs[1:]
+	return e
+}
+
+func (c *regionErrClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	c.lastTimeout = timeout
+	if e := c.next(); e != nil {
+		return &kvrpcpb.Response{Type: req.GetType(), RegionError: e}, nil
+	}
+	return c.Client.SendKVReq(ctx, addr, req, timeout)
+}
+
+func (c *regionErrClient) SendCopReq(ctx context.Context, addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error) {
+	c.lastTimeout = timeout
+	if e := c.next(); e != nil {
+		return &coprocessor.Response{RegionError: e}, nil
+	}
+	return c.Client.SendCopReq(ctx, addr, req, timeout)
+}
+
+// hangClient blocks until the context of the request is done.
+type hangClient struct {
+	Client
+}
+
+func (c *hangClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	<-ctx.Done()
+	return nil, errors.Trace(ctx.Err())
+}
+
+func (s *testRegionRequestSuite) TestCancel(c *C) {
+	req := &kvrpcpb.Request{
+		Type:      kvrpcpb.MessageType_CmdGet,
+		CmdGetReq: &kvrpcpb.CmdGetRequest{Key: []byte("a")},
+	}
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	addr := region.GetAddress()
+
+	// Cancel the running request.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	sender := NewRegionRequestSender(NewBackoffer(5000, ctx), s.cache, &hangClient{Client: s.client})
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+	c.Assert(time.Since(start), Less, time.Second)
+	// The peer is not blamed for the cancellation.
+	c.Assert(s.cache.GetRegionByVerID(region.VerID()).GetAddress(), Equals, addr)
+	advice, ok := RetryAdvice(err)
+	c.Assert(ok, IsTrue)
+	c.Assert(advice.Retryable, IsFalse)
+
+	// Cancel while backing off.
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{{ServerIsBusy: &errorpb.ServerIsBusy{}}}}
+	_, err = NewRegionRequestSender(NewBackoffer(5000, ctx), s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+	c.Assert(time.Since(start), Less, time.Second)
+
+	// A canceled coprocessor request is not sent.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	copReq := &coprocessor.Request{
+		Tp:     kv.ReqTypeSelect,
+		Ranges: []*coprocessor.KeyRange{{Start: []byte("a"), End: []byte("b")}},
+	}
+	client = &regionErrClient{Client: s.client}
+	_, err = NewRegionRequestSender(NewBackoffer(5000, ctx), s.cache, client).SendCopReq(copReq, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+	c.Assert(client.lastTimeout, Equals, time.Duration(0))
+
+	// The RPC timeout is shortened to the deadline of the request.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client = &regionErrClient{Client: s.client}
+	_, err = NewRegionRequestSender(NewBackoffer(5000, ctx), s.cache, client).SendKVReq(req, region.VerID(), readTimeoutLong)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout <= time.Second, IsTrue)
+	c.Assert(client.lastTimeout > 0, IsTrue)
+}
+
+func (s *testRegionRequestSuite) TestMinHealthyReplicas(c *C) {
+	var stores []uint64
+	for i := 0; i < 2; i++ {
+		storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+		s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+		s.cluster.AddPeer(s.region, storeID, peerID)
+		stores = append(stores, storeID)
+	}
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	for _, storeID := range stores {
+		for i := 0; i < storeUnreachableFailures; i++ {
+			s.cache.reportStoreResult(storeID, 0, false)
+		}
+		c.Assert(s.cache.StoreReachable(storeID), IsFalse)
+	}
+
+	putReq := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{
+			Key:   []byte("key"),
+			Value: []byte("value"),
+		},
+	}
+	getReq := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("key")},
+	}
+	sender := s.newSender()
+	sender.MinHealthyReplicas = 2
+	_, err = sender.SendKVReq(putReq, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrInsufficientReplicas)
+	// Reads are not checked.
+	_, err = sender.SendKVReq(getReq, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+
+	// A successful request makes the store reachable again.
+	s.cache.reportStoreResult(stores[0], time.Millisecond, true)
+	c.Assert(s.cache.StoreReachable(stores[0]), IsTrue)
+	_, err = sender.SendKVReq(putReq, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+}
+
+func (s *testRegionRequestSuite) TestReadCache(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{ReadCacheTTL: time.Minute, ReadCacheSize: 2})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	client := &recordClient{Client: s.client}
+	send := func(req *kvrpcpb.Request) *kvrpcpb.Response {
+		resp, err := NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+		c.Assert(err, IsNil)
+		return resp
+	}
+	put := func(key, value string) {
+		send(&kvrpcpb.Request{
+			Type:         kvrpcpb.MessageType_CmdRawPut,
+			CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{Key: []byte(key), Value: []byte(value)},
+		})
+	}
+	// get returns the value and whether it's sent to tikv.
+	get := func(key string) (string, bool) {
+		n := len(client.sent)
+		resp := send(&kvrpcpb.Request{
+			Type:         kvrpcpb.MessageType_CmdRawGet,
+			CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte(key)},
+		})
+		return string(resp.GetCmdRawGetResp().GetValue()), len(client.sent) > n
+	}
+	assertGet := func(key, value string, sent bool) {
+		v, ok := get(key)
+		c.Assert(v, Equals, value)
+		c.Assert(ok, Equals, sent)
+	}
+
+	put("a", "1")
+	assertGet("a", "1", true)
+	assertGet("a", "1", false)
+	// Writes invalidate the cached read.
+	put("a", "2")
+	assertGet("a", "2", true)
+	assertGet("a", "2", false)
+	// Region errors invalidate the cached reads of the region.
+	s.cache.reads.invalidateRegion(region.GetID())
+	assertGet("a", "2", true)
+	// The oldest entry is evicted.
+	assertGet("b", "", true)
+	assertGet("c", "", true)
+	assertGet("a", "2", true)
+
+	// Expired entries are not used.
+	ReconfigureSender(SenderConfig{ReadCacheTTL: time.Millisecond, ReadCacheSize: 2})
+	assertGet("d", "", true)
+	time.Sleep(5 * time.Millisecond)
+	assertGet("d", "", true)
+
+	// Nothing is cached if it's disabled.
+	ReconfigureSender(SenderConfig{})
+	assertGet("e", "", true)
+	assertGet("e", "", true)
+}
+
+func (s *testRegionRequestSuite) TestCheckKeyRange(c *C) {
+	newRegionID, newPeerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.Split(s.region, newRegionID, []byte("m"), []uint64{newPeerID}, newPeerID)
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	// The key is routed to a wrong region.
+
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{Key: []byte("x"), Value: []byte("v")},
+	}
+	client := &recordClient{Client: s.client}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	sender.CheckKeyRange = true
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError(), IsNil)
+	c.Assert(client.sent, HasLen, 1)
+	c.Assert(s.cache.GetRegionByVerID(region.VerID()), IsNil)
+	newRegion, err := s.cache.GetRegion(s.bo, []byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(newRegion.GetID(), Equals, newRegionID)
+
+	// Keys in different regions are returned to caller to split.
+	region, err = s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req = &kvrpcpb.Request{
+		Type:           kvrpcpb.MessageType_CmdBatchGet,
+		CmdBatchGetReq: &kvrpcpb.CmdBatchGetRequest{Keys: [][]byte{[]byte("a"), []byte("x")}},
+	}
+	client.sent = nil
+	resp, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+	c.Assert(client.sent, HasLen, 0)
+}
+
+func (s *testRegionRequestSuite) TestTimeoutEstimator(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	client := &regionErrClient{Client: s.client}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+
+	getReq := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	_, err = sender.SendKVReq(getReq, region.VerID(), 0)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, readTimeoutShort+timeoutPerKey)
+	// The timeout given by caller is used as is.
+	_, err = sender.SendKVReq(getReq, region.VerID(), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, time.Second)
+
+	scanReq := &kvrpcpb.Request{
+		Type:       kvrpcpb.MessageType_CmdScan,
+		CmdScanReq: &kvrpcpb.CmdScanRequest{StartKey: []byte("a"), Limit: 1000000},
+	}
+	_, err = sender.SendKVReq(scanReq, region.VerID(), 0)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, readTimeoutLong)
+
+	copReq := &coprocessor.Request{
+		Tp:     kv.ReqTypeSelect,
+		Ranges: []*coprocessor.KeyRange{{Start: []byte("a"), End: []byte("b")}},
+	}
+	c.Assert(sender.copTimeout(copReq, 0), Equals, readTimeoutMedium+timeoutPerRange)
+
+	sender.KVTimeoutEstimator = func(req *kvrpcpb.Request) time.Duration {
+		return 3 * time.Second
+	}
+	_, err = sender.SendKVReq(getReq, region.VerID(), 0)
+	c.Assert(err, IsNil)
+	c.Assert(client.lastTimeout, Equals, 3*time.Second)
+}
+
+func (s *testRegionRequestSuite) TestRegionErrorHistory(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{ServerBusyBackoff: &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter}})
+	s.cache.SetRegionErrorHistorySize(2)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	busy := func(msg string) *errorpb.Error {
+		return &errorpb.Error{Message: proto.String(msg), ServerIsBusy: &errorpb.ServerIsBusy{}}
+	}
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{busy("e1"), busy("e2"), busy("e3")}}
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	errs := s.cache.RecentRegionErrors()
+	c.Assert(errs, HasLen, 2)
+	for i, msg := range []string{"e2", "e3"} {
+		c.Assert(errs[i].Err, DeepEquals, busy(msg))
+		c.Assert(errs[i].RegionID, Equals, region.GetID())
+		c.Assert(errs[i].StoreAddr, Equals, region.GetAddress())
+	}
+
+	s.cache.SetRegionErrorHistorySize(0)
+	client.errs = []*errorpb.Error{busy("e4")}
+	_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(s.cache.RecentRegionErrors(), HasLen, 0)
+}
+
+func (s *testRegionRequestSuite) TestTouchedPD(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	sender := s.newSender()
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().TouchedPD, IsFalse)
+
+	// Switching to the new leader loads its store.
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	s.cluster.AddPeer(s.region, storeID, peerID)
+	s.cluster.ChangeLeader(s.region, peerID)
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().TouchedPD, IsTrue)
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().TouchedPD, IsFalse)
+
+	// Reloading the region missing in cache.
+	region, err = s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	s.cache.DropRegion(region.VerID())
+	sender.CacheMissPolicy = CacheMissReload
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().TouchedPD, IsTrue)
+}
+
+func (s *testRegionRequestSuite) TestLastChanceRead(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{ServerBusyBackoff: &BackoffConfig{Base: 2, Cap: 2, Jitter: NoJitter}})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	busy := &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}
+	getReq := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	putReq := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{Key: []byte("a"), Value: []byte("v")},
+	}
+	send := func(req *kvrpcpb.Request, lastChance bool, errs ...*errorpb.Error) error {
+		client := &regionErrClient{Client: s.client, errs: errs}
+		sender := NewRegionRequestSender(NewBackoffer(1, context.Background()), s.cache, client)
+		sender.LastChanceRead = lastChance
+		_, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+		return err
+	}
+
+	c.Assert(send(getReq, false, busy), NotNil)
+	c.Assert(send(getReq, true, busy), IsNil)
+	// The last chance is taken only once.
+	err = send(getReq, true, busy, busy)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), txnRetryableMark), IsTrue)
+	// Writes are not retried.
+	c.Assert(send(putReq, true, busy), NotNil)
+}
+
+func (s *testRegionRequestSuite) TestCommitTS(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	sender := s.newSender()
+	prewrite := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdPrewrite,
+		CmdPrewriteReq: &kvrpcpb.CmdPrewriteRequest{
+			Mutations:    []*kvrpcpb.Mutation{{Op: kvrpcpb.Op_Put, Key: []byte("a"), Value: []byte("v")}},
+			PrimaryLock:  []byte("a"),
+			StartVersion: 10,
+			LockTtl:      3000,
+		},
+	}
+	_, err = sender.SendKVReq(prewrite, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().CommitTS, Equals, uint64(0))
+
+	commit := &kvrpcpb.Request{
+		Type: kvrpcpb.MessageType_CmdCommit,
+		CmdCommitReq: &kvrpcpb.CmdCommitRequest{
+			StartVersion:  10,
+			Keys:          [][]byte{[]byte("a")},
+			CommitVersion: 11,
+		},
+	}
+	_, err = sender.SendKVReq(commit, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().CommitTS, Equals, uint64(11))
+
+	get := &kvrpcpb.Request{
+		Type:      kvrpcpb.MessageType_CmdGet,
+		CmdGetReq: &kvrpcpb.CmdGetRequest{Key: []byte("a"), Version: 12},
+	}
+	resp, err := sender.SendKVReq(get, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetCmdGetResp().GetValue(), BytesEquals, []byte("v"))
+	c.Assert(sender.Meta().CommitTS, Equals, uint64(0))
+}
+
+func (s *testRegionRequestSuite) TestReloadStagger(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	send := func(ctx context.Context) error {
+		stale := &errorpb.Error{StaleEpoch: &errorpb.StaleEpoch{
+			NewRegions: []*metapb.Region{proto.Clone(region.meta).(*metapb.Region)},
+		}}
+		client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{stale}}
+		region, err := s.cache.GetRegion(s.bo, []byte("a"))
+		c.Assert(err, IsNil)
+		_, err = NewRegionRequestSender(NewBackoffer(5000, ctx), s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+		return err
+	}
+
+	ReconfigureSender(SenderConfig{ReloadStagger: 10 * time.Millisecond})
+	c.Assert(send(context.Background()), IsNil)
+
+	// The stagger gives up when the request is canceled.
+	ReconfigureSender(SenderConfig{ReloadStagger: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	c.Assert(errors.Cause(send(ctx)), Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start), Less, time.Second)
+}
+
+func (s *testRegionRequestSuite) TestRequestStats(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{ServerBusyBackoff: &BackoffConfig{Base: 2, Cap: 2, Jitter: NoJitter}})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{
+		{ServerIsBusy: &errorpb.ServerIsBusy{}},
+		{ServerIsBusy: &errorpb.ServerIsBusy{}},
+		s.notLeaderErr(),
+	}}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	stats := sender.Stats()
+	c.Assert(stats.ServerBusy, Equals, 2)
+	c.Assert(stats.NotLeader, Equals, 1)
+	c.Assert(stats.StaleEpoch, Equals, 0)
+	c.Assert(stats.SendFail, Equals, 0)
+	c.Assert(stats.BackoffTime > 0, IsTrue)
+
+	// Stats are reset by the next request.
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Stats(), DeepEquals, RequestStats{})
+}
+
+func (s *testRegionRequestSuite) TestRetryBudget(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{ServerBusyBackoff: &BackoffConfig{Base: 20, Cap: 20, Jitter: NoJitter}})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	busy := &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{busy, busy}}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	sender.MaxRetries = 2
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+
+	client.errs = []*errorpb.Error{busy, busy, busy}
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrRetryExhausted)
+	c.Assert(strings.Contains(err.Error(), "last region error: server_is_busy"), IsTrue)
+	c.Assert(sender.LastRegionError().GetServerIsBusy(), NotNil)
+
+	client.errs = []*errorpb.Error{busy, busy, busy, busy, busy}
+	sender = NewRegionRequestSender(s.bo, s.cache, client)
+	sender.MaxRetryTime = 30 * time.Millisecond
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrRetryExhausted)
+
+	// Retries get the timeout left of MaxRetryTime.
+	recorder := &timeoutRecordClient{Client: &regionErrClient{Client: s.client, errs: []*errorpb.Error{busy}}}
+	sender = NewRegionRequestSender(s.bo, s.cache, recorder)
+	sender.MaxRetryTime = time.Second
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.LastRegionError().GetServerIsBusy(), NotNil)
+	c.Assert(recorder.timeouts, HasLen, 2)
+	c.Assert(recorder.timeouts[0], Equals, readTimeoutShort)
+	c.Assert(recorder.timeouts[1] <= time.Second, IsTrue)
+
+	// The last region error is reset by the next request.
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.LastRegionError(), IsNil)
+}
+
+type timeoutRecordClient struct {
+	Client
+	timeouts []time.Duration
+}
+
+func (c *timeoutRecordClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	c.timeouts = append(c.timeouts, timeout)
+	return c.Client.SendKVReq(ctx, addr, req, timeout)
+}
+
+func (s *testRegionRequestSuite) TestUnknownRegionError(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{{Message: proto.String("raft entry too large")}}}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrUnknownRegionError)
+	c.Assert(strings.Contains(err.Error(), "raft entry too large"), IsTrue)
+	c.Assert(strings.Contains(err.Error(), txnRetryableMark), IsFalse)
+	c.Assert(s.cache.GetRegionByVerID(region.VerID()), IsNil)
+
+	// `KeyNotInRegion` backs off before the region bounces back to caller.
+	region, err = s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	client.errs = []*errorpb.Error{{KeyNotInRegion: &errorpb.KeyNotInRegion{}}}
+	sender = NewRegionRequestSender(s.bo, s.cache, client)
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+	c.Assert(sender.Stats().BackoffTime > 0, IsTrue)
+}
+
+func (s *testRegionRequestSuite) TestBusyTimeout(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{
+		ServerBusyBackoff: &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter},
+		BusyTimeoutFactor: 3,
+	})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	client := &regionErrClient{Client: s.client}
+	_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), time.Millisecond)
+	c.Assert(err, IsNil)
+	// Without `ServerIsBusy`, the timeout is unchanged.
+	c.Assert(client.lastTimeout, Equals, time.Millisecond)
+	c.Assert(s.cache.StoreBusy(s.store), IsFalse)
+
+	s.cache.reportStoreResult(s.store, time.Second, true)
+	client.errs = []*errorpb.Error{{ServerIsBusy: &errorpb.ServerIsBusy{}}}
+	_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(s.cache.StoreBusy(s.store), IsTrue)
+	// The retry after `ServerIsBusy` waits for the slow store.
+	c.Assert(client.lastTimeout > 100*time.Millisecond, IsTrue)
+}
+
+func (s *testRegionRequestSuite) TestRPCError(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sender := NewRegionRequestSender(NewBackoffer(5000, ctx), s.cache, &hangClient{Client: s.client})
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, context.DeadlineExceeded)
+
+	rpcErr, ok := RPCErrorOf(errors.Trace(err))
+	c.Assert(ok, IsTrue)
+	c.Assert(rpcErr.Region, Equals, region.VerID())
+	c.Assert(rpcErr.StoreAddr, Equals, region.GetAddress())
+	c.Assert(rpcErr.PeerID, Equals, s.peer)
+	_, ok = RetryAdvice(err)
+	c.Assert(ok, IsTrue)
+
+	_, ok = RPCErrorOf(errors.New("other"))
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testRegionRequestSuite) TestRegionErrorHook(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	errs := []*errorpb.Error{
+		{StaleEpoch: &errorpb.StaleEpoch{NewRegions: []*metapb.Region{proto.Clone(region.meta).(*metapb.Region)}}},
+		s.notLeaderErr(),
+	}
+	var called int
+	sender := s.newSender()
+	sender.RegionErrorHook = func(e *errorpb.Error) *errorpb.Error {
+		c.Assert(e, IsNil)
+		called++
+		if len(errs) == 0 {
+			return nil
+		}
+		e, errs = errs[0], errs[1:]
+		return e
+	}
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError(), IsNil)
+	c.Assert(called, Equals, 3)
+	stats := sender.Stats()
+	c.Assert(stats.StaleEpoch, Equals, 1)
+	c.Assert(stats.NotLeader, Equals, 1)
+}
+
+func (s *testRegionRequestSuite) TestNotLeaderUncachedPeer(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	// A new peer becomes leader after the region is cached.
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	s.cluster.AddPeer(s.region, storeID, peerID)
+	s.cluster.ChangeLeader(s.region, peerID)
+
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	sender := s.newSender()
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Meta().TouchedPD, IsTrue)
+	c.Assert(sender.Stats().NotLeader, Equals, 1)
+	c.Assert(sender.Stats().BackoffTime, Equals, time.Duration(0))
+	// The member change bumps the epoch, so the request bounces back to
+	// caller, which re-splits it by the reloaded region.
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+	r := s.cache.getRegionFromCache([]byte("a"))
+	c.Assert(r, NotNil)
+	c.Assert(regionHasPeer(r, peerID), IsTrue)
+}
+
+type testSpan struct {
+	op     string
+	parent *testSpan
+	tags   map[string]interface{}
+	done   bool
+}
+
+func (s *testSpan) SetTag(key string, value interface{}) { s.tags[key] = value }
+func (s *testSpan) Finish()                              { s.done = true }
+
+type testSpanKey struct{}
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, op string) (Span, context.Context) {
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	span := &testSpan{op: op, parent: parent, tags: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return span, context.WithValue(ctx, testSpanKey{}, span)
+}
+
+func (s *testRegionRequestSuite) TestTracer(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{ServerBusyBackoff: &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter}})
+	tracer := &testTracer{}
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	root := &testSpan{op: "query", tags: make(map[string]interface{})}
+	ctx := context.WithValue(context.Background(), testSpanKey{}, root)
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{{ServerIsBusy: &errorpb.ServerIsBusy{}}}}
+	_, err = NewRegionRequestSender(NewBackoffer(5000, ctx), s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+
+	var ops []string
+	for _, span := range tracer.spans {
+		ops = append(ops, span.op)
+		c.Assert(span.done, IsTrue)
+	}
+	c.Assert(ops, DeepEquals, []string{SpanSendKVReq, SpanAttempt, SpanBackoff, SpanAttempt})
+	reqSpan := tracer.spans[0]
+	c.Assert(reqSpan.parent, Equals, root)
+	c.Assert(reqSpan.tags["region_id"], Equals, s.region)
+	c.Assert(reqSpan.tags["success"], Equals, true)
+	for _, span := range tracer.spans[1:] {
+		c.Assert(span.parent, Equals, reqSpan)
+	}
+	c.Assert(tracer.spans[1].tags["region_error"], Equals, "server_is_busy")
+	c.Assert(tracer.spans[1].tags["store_addr"], Equals, region.GetAddress())
+	c.Assert(tracer.spans[1].tags["retry"], Equals, 0)
+	c.Assert(tracer.spans[2].tags["backoff"], Equals, boServerBusy.String())
+	c.Assert(strings.Contains(tracer.spans[2].tags["reason"].(string), "server is busy"), IsTrue)
+	c.Assert(tracer.spans[3].tags["success"], Equals, true)
+	c.Assert(tracer.spans[3].tags["retry"], Equals, 1)
+
+	// No span is started once the tracer is removed.
+	SetTracer(nil)
+	_, err = NewRegionRequestSender(NewBackoffer(5000, ctx), s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(tracer.spans, HasLen, 4)
+}
+
+func (s *testRegionRequestSuite) TestRoute(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	sender := s.newSender()
+	sender.AddrRewriter = func(storeID uint64, addr string) string { return "proxy/" + addr }
+	plan, err := sender.Route(req, region.VerID())
+	c.Assert(err, IsNil)
+	c.Assert(plan.Region, Equals, region.VerID())
+	c.Assert(plan.PeerID, Equals, s.peer)
+	c.Assert(plan.StoreID, Equals, s.store)
+	c.Assert(plan.StoreAddr, Equals, region.GetAddress())
+	c.Assert(plan.DialAddr, Equals, "proxy/"+region.GetAddress())
+	c.Assert(plan.Context.GetPeer().GetId(), Equals, s.peer)
+	// Nothing is sent.
+	c.Assert(sender.Stats(), DeepEquals, RequestStats{})
+
+	// The plan follows the leader learned by real requests.
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	s.cluster.AddPeer(s.region, storeID, peerID)
+	s.cluster.ChangeLeader(s.region, peerID)
+	sender.AddrRewriter = nil
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	plan, err = sender.Route(req, region.VerID())
+	c.Assert(err, IsNil)
+	c.Assert(plan, IsNil)
+	region, err = s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	plan, err = sender.Route(req, region.VerID())
+	c.Assert(err, IsNil)
+	c.Assert(plan.PeerID, Equals, peerID)
+	c.Assert(plan.StoreAddr, Equals, fmt.Sprintf("store%d", storeID))
+}
+
+func (s *testRegionRequestSuite) TestRouteSharesDecision(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	cfg := SenderConfig{
+		CircuitBreakerFailures: 1,
+		CircuitBreakerCooldown: time.Minute,
+		StoreMaxInflight:       1,
+	}
+	ReconfigureSender(cfg)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	putReq := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{Key: []byte("a"), Value: []byte("v")},
+	}
+	sender := s.newSender()
+
+	// The store is busy.
+	c.Assert(s.cache.acquireStore(context.Background(), s.store, 1, &cfg), IsNil)
+	plan, err := sender.Route(putReq, region.VerID())
+	c.Assert(err, IsNil)
+	c.Assert(plan.Limited, IsTrue)
+	s.cache.releaseStore(s.store, 1, true, false, &cfg)
+	plan, err = sender.Route(putReq, region.VerID())
+	c.Assert(err, IsNil)
+	c.Assert(plan.Limited, IsFalse)
+
+	// The circuit of the store is open, and stays open after Route.
+	s.cache.reportCircuit(s.store, region.GetAddress(), false, &cfg)
+	plan, err = sender.Route(putReq, region.VerID())
+	c.Assert(err, IsNil)
+	c.Assert(plan.CircuitOpen, IsTrue)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitOpen)
+	s.cache.ResetCircuit(s.store)
+
+	// Writes need enough healthy replicas.
+	for i := 0; i < storeUnreachableFailures; i++ {
+		s.cache.reportStoreResult(s.store, 0, false)
+	}
+	sender.MinHealthyReplicas = 1
+	_, err = sender.Route(putReq, region.VerID())
+	c.Assert(errors.Cause(err), Equals, ErrInsufficientReplicas)
+	_, err = sender.SendKVReq(putReq, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrInsufficientReplicas)
+}
+
+// dialFailClient fails to send requests without writing them.
+type dialFailClient struct {
+	Client
+}
+
+func (c *dialFailClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	return nil, errors.Trace(&notSentError{err: errors.New("connection refused")})
+}
+
+func (s *testRegionRequestSuite) TestStrictWriteRetry(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{TiKVRPCBackoff: &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter}})
+
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawPut,
+		CmdRawPutReq: &kvrpcpb.CmdRawPutRequest{Key: []byte("a"), Value: []byte("v")},
+	}
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	sender := NewRegionRequestSender(s.bo, s.cache, &sendFailClient{Client: s.client})
+	sender.StrictWriteRetry = true
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(errors.Cause(err), Equals, ErrResultUndetermined)
+	advice, ok := RetryAdvice(err)
+	c.Assert(ok, IsTrue)
+	c.Assert(advice.Effect, Equals, EffectUnknown)
+	// The region is kept, the write is not retried on other peers.
+	c.Assert(s.cache.GetRegionByVerID(region.VerID()), NotNil)
+
+	// A request that is surely not sent is retried as before. The only
+	// peer is dropped, so the request bounces back to caller.
+	sender = NewRegionRequestSender(s.bo, s.cache, &dialFailClient{Client: s.client})
+	sender.StrictWriteRetry = true
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+}
+
+// countFailClient fails all requests and counts them.
+type countFailClient struct {
+	Client
+	sent int
+}
+
+func (c *countFailClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	c.sent++
+	return nil, errors.New("connection reset")
+}
+
+func (s *testRegionRequestSuite) TestCircuitBreaker(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{
+		TiKVRPCBackoff:         &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter},
+		CircuitBreakerFailures: 2,
+		CircuitBreakerCooldown: 50 * time.Millisecond,
+	})
+
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	send := func(client Client) *kvrpcpb.Response {
+		region, err := s.cache.GetRegion(s.bo, []byte("a"))
+		c.Assert(err, IsNil)
+		resp, err := NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+		c.Assert(err, IsNil)
+		return resp
+	}
+
+	client := &countFailClient{Client: s.client}
+	send(client)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitClosed)
+	send(client)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitOpen)
+	// The open store is skipped, the only peer is dropped.
+	resp := send(client)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+	c.Assert(client.sent, Equals, 2)
+
+	// A failed probe opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitHalfOpen)
+	send(client)
+	c.Assert(client.sent, Equals, 3)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitOpen)
+
+	// A successful probe closes it.
+	time.Sleep(60 * time.Millisecond)
+	resp = send(s.client)
+	c.Assert(resp.GetRegionError(), IsNil)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitClosed)
+
+	send(client)
+	send(client)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitOpen)
+	s.cache.ResetCircuit(s.store)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitClosed)
+}
+
+func (s *testRegionRequestSuite) TestCircuitStates(c *C) {
+	cfg := SenderConfig{
+		CircuitBreakerFailures: 2,
+		CircuitBreakerCooldown: time.Minute,
+	}
+	storeID := s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	c.Assert(s.cache.getStore(storeID), NotNil)
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	addr := region.GetAddress()
+	s.cache.reportCircuit(s.store, addr, false, &cfg)
+	states := s.cache.CircuitStates()
+	c.Assert(states, HasLen, 2)
+	c.Assert(states[0], DeepEquals, CircuitState{StoreID: s.store, StoreAddr: addr, Status: CircuitClosed, Failures: 1})
+	c.Assert(states[1], DeepEquals, CircuitState{StoreID: storeID, StoreAddr: fmt.Sprintf("store%d", storeID)})
+
+	s.cache.reportCircuit(s.store, addr, false, &cfg)
+	states = s.cache.CircuitStates()
+	c.Assert(states[0].Status, Equals, CircuitOpen)
+	c.Assert(states[0].Failures, Equals, 2)
+	c.Assert(states[0].NextProbe > 0 && states[0].NextProbe <= time.Minute, IsTrue)
+
+	s.cache.ResetCircuit(s.store)
+	c.Assert(s.cache.CircuitStates()[0], DeepEquals, CircuitState{StoreID: s.store, StoreAddr: addr})
+}
+
+func (s *testRegionRequestSuite) TestCircuitBreakerBackgroundProbe(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{
+		TiKVRPCBackoff:                &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter},
+		CircuitBreakerFailures:        1,
+		CircuitBreakerCooldown:        20 * time.Millisecond,
+		CircuitBreakerBackgroundProbe: true,
+	})
+
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	send := func(client Client) *kvrpcpb.Response {
+		region, err := s.cache.GetRegion(s.bo, []byte("a"))
+		c.Assert(err, IsNil)
+		resp, err := NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+		c.Assert(err, IsNil)
+		return resp
+	}
+
+	client := &countFailClient{Client: s.client}
+	send(client)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitOpen)
+
+	// No request is let through after the cooldown.
+	time.Sleep(30 * time.Millisecond)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitHalfOpen)
+	send(client)
+	c.Assert(client.sent, Equals, 1)
+
+	// A failed probe opens the circuit again.
+	s.cache.reportCircuitProbe(s.store, false, loadSenderConfig())
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitOpen)
+
+	// The only peer was dropped, cache the region again so the sweeper
+	// probes its store.
+	_, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	sweeper := NewHealthSweeper(s.cache, s.client, HealthSweepConfig{
+		Interval:     10 * time.Millisecond,
+		ProbeTimeout: time.Second,
+	})
+	for i := 0; i < 100 && s.circuitStatus(s.store) != CircuitClosed; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sweeper.Close()
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitClosed)
+	resp := send(s.client)
+	c.Assert(resp.GetRegionError(), IsNil)
+}
+
+func (s *testRegionRequestSuite) TestBackoffMaxSleep(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{
+		ServerBusyBackoff: &BackoffConfig{Base: 2, Cap: 2, Jitter: NoJitter, MaxSleep: 5},
+		CopMaxBackoff:     1000,
+	})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	busy := &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{busy, busy, busy, busy, busy}}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), txnRetryableMark), IsTrue)
+	c.Assert(ErrTiKVServerBusy.Equal(err), IsTrue)
+	c.Assert(sender.Stats().ServerBusy, Equals, 3)
+
+	cfg := loadSenderConfig()
+	c.Assert(cfg.copMaxBackoff(), Equals, 1000)
+	c.Assert(cfg.pointGetMaxBackoff(getMaxBackoff), Equals, getMaxBackoff)
+}
+
+func (s *testRegionRequestSuite) TestBackoffForkMaxSleep(c *C) {
+	createFn := func() func() int { return newBackoffSeq(2, 2, NoJitter) }
+	bo := NewBackoffer(1000, context.Background())
+	c.Assert(bo.backoffWith(boServerBusy, createFn, 5, errors.New("busy")), IsNil)
+	c.Assert(bo.backoffWith(boServerBusy, createFn, 5, errors.New("busy")), IsNil)
+
+	// The fork keeps the sleep of each type, and does not share it.
+	forked := bo.Fork()
+	c.Assert(forked.typeSleep[boServerBusy], Equals, 4)
+	c.Assert(forked.backoffWith(boTiKVRPC, createFn, 5, errors.New("send fail")), IsNil)
+	c.Assert(bo.typeSleep[boTiKVRPC], Equals, 0)
+	err := forked.backoffWith(boServerBusy, createFn, 5, errors.New("busy"))
+	c.Assert(ErrTiKVServerBusy.Equal(err), IsTrue)
+}
+
+func (s *testRegionRequestSuite) TestBackoffTypedError(c *C) {
+	bo := NewBackoffer(5, context.Background())
+	bo.fn = map[backoffType]func() int{
+		boRegionMiss: newBackoffSeq(4, 4, NoJitter),
+		boTiKVRPC:    newBackoffSeq(2, 2, NoJitter),
+	}
+	c.Assert(bo.Backoff(boRegionMiss, errors.New("region miss")), IsNil)
+	err := bo.Backoff(boTiKVRPC, errors.New("send fail"))
+	c.Assert(err, NotNil)
+	// The region miss has slept longer.
+	c.Assert(ErrRegionUnavailable.Equal(err), IsTrue)
+	c.Assert(kv.IsRetryableError(err), IsTrue)
+	sqlErr := errors.Cause(err).(*terror.Error).ToSQLError()
+	c.Assert(sqlErr.Code, Equals, uint16(mysql.ErrRegionUnavailable))
+}
+
+func (s *testRegionRequestSuite) TestRuntimeStats(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{ServerBusyBackoff: &BackoffConfig{Base: 2, Cap: 2, Jitter: NoJitter}})
+
+	stats := &RuntimeStats{}
+	bo := NewBackoffer(5000, WithRuntimeStats(context.Background(), stats))
+	region, err := s.cache.GetRegion(bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{
+		{ServerIsBusy: &errorpb.ServerIsBusy{}},
+		s.notLeaderErr(),
+	}}
+	_, err = NewRegionRequestSender(bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	_, err = NewRegionRequestSender(bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+
+	got := stats.Stats()
+	c.Assert(got.Requests, Equals, 2)
+	c.Assert(got.RPCs, Equals, 4)
+	c.Assert(got.RPCTime > 0, IsTrue)
+	c.Assert(got.SendFails, Equals, 0)
+	c.Assert(got.RegionErrors, DeepEquals, map[string]int{"server_is_busy": 1, "not_leader": 1})
+	c.Assert(got.Backoff["serverBusy"] > 0, IsTrue)
+	c.Assert(strings.Contains(got.String(), "requests: 2, rpc: 4"), IsTrue)
+	c.Assert(strings.Contains(got.String(), "region_err: {not_leader: 1, server_is_busy: 1}"), IsTrue)
+
+	// Requests without it in context are not collected.
+	_, err = NewRegionRequestSender(s.bo, s.cache, s.client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Stats().Requests, Equals, 2)
+}
+
+func (s *testRegionRequestSuite) TestScriptedClient(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	fast := &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter}
+	ReconfigureSender(SenderConfig{TiKVRPCBackoff: fast, RegionMissBackoff: fast, ServerBusyBackoff: fast})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	client := mocktikv.NewScriptedClient(s.client)
+	client.Script(s.region,
+		mocktikv.NotLeaderStep(s.region, &metapb.Peer{Id: s.peer, StoreId: s.store}),
+		mocktikv.ServerIsBusyStep(),
+		mocktikv.ScriptStep{Delay: time.Millisecond},
+	)
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError(), IsNil)
+	c.Assert(client.Pending(s.region), Equals, 0)
+	c.Assert(sender.Stats().NotLeader, Equals, 1)
+	c.Assert(sender.Stats().ServerBusy, Equals, 1)
+
+	// A timed out request fails to send.
+	client.Script(s.region, mocktikv.ScriptStep{Delay: time.Second})
+	_, err = sender.SendKVReq(req, region.VerID(), 10*time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Stats().SendFail, Equals, 1)
+
+	// `StaleEpoch` with the new regions updates the cache.
+	region, err = s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	meta, _ := s.cluster.GetRegion(s.region)
+	client.Script(s.region, mocktikv.StaleEpochStep(meta), mocktikv.ScriptStep{SendErr: errors.New("connection reset")})
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(sender.Stats().StaleEpoch, Equals, 1)
+	c.Assert(sender.Stats().SendFail, Equals, 1)
+	c.Assert(client.Pending(s.region), Equals, 0)
+}
+
+// redirectClient answers every request with `NotLeader` naming leader, and
+// counts the requests by address.
+type redirectClient struct {
+	Client
+	leader *metapb.Peer
+	sent   map[string]int
+}
+
+func (c *redirectClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+	c.sent[addr]++
+	return &kvrpcpb.Response{
+		Type:        req.GetType(),
+		RegionError: &errorpb.Error{NotLeader: &errorpb.NotLeader{RegionId: proto.Uint64(req.GetContext().GetRegionId()), Leader: c.leader}},
+	}, nil
+}
+
+func (s *testRegionRequestSuite) TestCircuitBreakerNotLeader(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	cfg := SenderConfig{
+		TiKVRPCBackoff:         &BackoffConfig{Base: 10, Cap: 10, Jitter: NoJitter},
+		RegionMissBackoff:      &BackoffConfig{Base: 10, Cap: 10, Jitter: NoJitter},
+		CircuitBreakerFailures: 1,
+		CircuitBreakerCooldown: time.Minute,
+	}
+	ReconfigureSender(cfg)
+
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, fmt.Sprintf("store%d", storeID))
+	s.cluster.AddPeer(s.region, storeID, peerID)
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	leaderAddr := region.GetAddress()
+	s.cache.reportCircuit(s.store, leaderAddr, false, &cfg)
+	c.Assert(s.circuitStatus(s.store), Equals, CircuitOpen)
+
+	// The follower redirects to the open leader. The request backs off
+	// instead of switching between them until it runs out of retries.
+	client := &redirectClient{
+		Client: s.client,
+		leader: &metapb.Peer{Id: s.peer, StoreId: s.store},
+		sent:   make(map[string]int),
+	}
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	sender := NewRegionRequestSender(NewBackoffer(100, context.Background()), s.cache, client)
+	_, err = sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, NotNil)
+	c.Assert(client.sent[leaderAddr], Equals, 0)
+	c.Assert(client.sent[fmt.Sprintf("store%d", storeID)] <= 11, IsTrue)
+	c.Assert(sender.Stats().BackoffTime > 0, IsTrue)
+	region, err = s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(region.GetAddress(), Not(Equals), leaderAddr)
+}
+
+func (s *testRegionRequestSuite) TestNotLeaderPeerUnknownToPD(c *C) {
+	region, err := s.cache.GetRegion(s.bo, []byte("a"))
+	c.Assert(err, IsNil)
+	// The leader is a peer that PD does not know yet.
+	client := &redirectClient{
+		Client: s.client,
+		leader: &metapb.Peer{Id: s.cluster.AllocID(), StoreId: s.store},
+		sent:   make(map[string]int),
+	}
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("a")},
+	}
+	sender := NewRegionRequestSender(s.bo, s.cache, client)
+	resp, err := sender.SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	c.Assert(resp.GetRegionError().GetStaleEpoch(), NotNil)
+	c.Assert(client.sent[region.GetAddress()], Equals, 1)
+	c.Assert(s.cache.getRegionFromCache([]byte("a")), IsNil)
+}
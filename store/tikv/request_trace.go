@@ -0,0 +1,256 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+)
+
+// Kinds of TraceEvent.
+const (
+	TraceAttempt     = "attempt"
+	TraceSendFail    = "send_fail"
+	TraceRegionError = "region_error"
+	TraceRegionMiss  = "region_miss"
+	TraceBackoff     = "backoff"
+)
+
+// RequestTrace is the lifecycle of a request sent by RegionRequestSender. It
+// is written to the trace file as one JSON line, see EnableRequestTrace.
+type RequestTrace struct {
+	Type      string        `json:"type"`
+	RegionID  uint64        `json:"region_id"`
+	StartTime time.Time     `json:"start_time"`
+	Duration  time.Duration `json:"duration"`
+	Events    []TraceEvent  `json:"events"`
+	// Outcome is one of AuditSuccess, AuditRegionError and AuditError.
+	Outcome string `json:"outcome"`
+	Err     string `json:"error,omitempty"`
+}
+
+// TraceEvent is a step of a request.
+type TraceEvent struct {
+	Kind string `json:"kind"`
+	// Offset is the time from the start of request to the start of event.
+	Offset time.Duration `json:"offset"`
+	// Duration is set for TraceAttempt.
+	Duration  time.Duration `json:"duration,omitempty"`
+	StoreAddr string        `json:"store_addr,omitempty"`
+	Detail    string        `json:"detail,omitempty"`
+}
+
+// traceQueueSize is the max number of traces waiting to be written. Traces
+// are dropped if the queue is full.
+const traceQueueSize = 1024
+
+type traceWriter struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	ch      chan *RequestTrace
+	done    chan struct{}
+	wg      sync.WaitGroup
+	dropped uint64
+}
+
+type traceWriterHolder struct {
+	w *traceWriter
+}
+
+var requestTrace struct {
+	sync.Mutex
+	writer atomic.Value
+}
+
+// EnableRequestTrace starts dumping the trace of every request to the file at
+// path. When the file grows beyond maxSize bytes, it is renamed to path.1 and
+// a new file is created. Traces are written in background, and dropped if the
+// writer falls behind. It is heavy and meant for debugging only.
+func EnableRequestTrace(path string, maxSize int64) error {
+	requestTrace.Lock()
+	defer requestTrace.Unlock()
+
+	if w := getTraceWriter(); w != nil {
+		w.stop()
+	}
+	w := &traceWriter{
+		path:    path,
+		maxSize: maxSize,
+		ch:      make(chan *RequestTrace, traceQueueSize),
+		done:    make(chan struct{}),
+	}
+	if err := w.open(); err != nil {
+		requestTrace.writer.Store(traceWriterHolder{})
+		return errors.Trace(err)
+	}
+	w.wg.Add(1)
+	go w.run()
+	requestTrace.writer.Store(traceWriterHolder{w: w})
+	return nil
+}
+
+// DisableRequestTrace stops dumping traces. Queued traces are written before
+// it returns.
+func DisableRequestTrace() {
+	requestTrace.Lock()
+	defer requestTrace.Unlock()
+
+	if w := getTraceWriter(); w != nil {
+		requestTrace.writer.Store(traceWriterHolder{})
+		w.stop()
+	}
+}
+
+func getTraceWriter() *traceWriter {
+	h, _ := requestTrace.writer.Load().(traceWriterHolder)
+	return h.w
+}
+
+func (w *traceWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+func (w *traceWriter) record(t *RequestTrace) {
+	select {
+	case w.ch <- t:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+func (w *traceWriter) stop() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+func (w *traceWriter) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case t := <-w.ch:
+			w.write(t)
+		case <-w.done:
+			for {
+				select {
+				case t := <-w.ch:
+					w.write(t)
+				default:
+					if dropped := atomic.LoadUint64(&w.dropped); dropped > 0 {
+						log.Warnf("request trace: %d traces dropped", dropped)
+					}
+					if w.file != nil {
+						w.file.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *traceWriter) write(t *RequestTrace) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		log.Warnf("request trace: marshal failed: %v", err)
+		return
+	}
+	if w.file == nil {
+		return
+	}
+	data = append(data, '\n')
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(data)) > w.maxSize {
+		w.rotate()
+	}
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		log.Warnf("request trace: write %s failed: %v", w.path, err)
+	}
+}
+
+func (w *traceWriter) rotate() {
+	w.file.Close()
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		log.Warnf("request trace: rotate %s failed: %v", w.path, err)
+	}
+	if err := w.open(); err != nil {
+		log.Warnf("request trace: reopen %s failed: %v", w.path, err)
+		// Traces are discarded until the trace is enabled again.
+		w.file = nil
+	}
+}
+
+func (s *RegionRequestSender) startTrace(tp string, regionID RegionVerID, start time.Time) {
+	if getTraceWriter() == nil {
+		return
+	}
+	s.trace = &RequestTrace{
+		Type:      tp,
+		RegionID:  regionID.id,
+		StartTime: start,
+	}
+}
+
+func (s *RegionRequestSender) traceEvent(kind string, start time.Time, detail string) {
+	if s.trace == nil {
+		return
+	}
+	e := TraceEvent{
+		Kind:   kind,
+		Offset: start.Sub(s.trace.StartTime),
+		Detail: detail,
+	}
+	if kind == TraceAttempt {
+		e.Duration = time.Since(start)
+		e.StoreAddr = s.storeAddr
+	}
+	s.trace.Events = append(s.trace.Events, e)
+}
+
+func (s *RegionRequestSender) finishTrace(regionErr *errorpb.Error, err error) {
+	t := s.trace
+	if t == nil {
+		return
+	}
+	s.trace = nil
+	t.Duration = time.Since(t.StartTime)
+	t.Outcome = AuditSuccess
+	if err != nil {
+		t.Outcome, t.Err = AuditError, err.Error()
+	} else if regionErr != nil {
+		t.Outcome, t.Err = AuditRegionError, regionErr.String()
+	}
+	if w := getTraceWriter(); w != nil {
+		w.record(t)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+// Effect tells whether a failed request may have taken effect on tikv.
+type Effect int
+
+// Effect values.
+const (
+	// EffectNotApplied means the request is a read, or no attempt of it
+	// has reached tikv.
+	EffectNotApplied Effect = iota
+	// EffectUnknown means a write may have been applied, because sending
+	// it failed after it might have been written to the connection.
+	EffectUnknown
+)
+
+// Advice tells caller whether and how to retry a failed request.
+type Advice struct {
+	Retryable bool
+	// Delay is the suggested wait before retrying.
+	Delay  time.Duration
+	Effect Effect
+}
+
+// adviceError attaches Advice to an error returned by RegionRequestSender.
+// It keeps the message and cause of the original error.
+type adviceError struct {
+	err    error
+	advice Advice
+}
+
+func (e *adviceError) Error() string {
+	return e.err.Error()
+}
+
+// Cause implements the causer interface of juju errors.
+func (e *adviceError) Cause() error {
+	return errors.Cause(e.err)
+}
+
+// RetryAdvice extracts the Advice of an error returned by
+// RegionRequestSender. ok is false if the error carries no Advice.
+func RetryAdvice(err error) (advice *Advice, ok bool) {
+	for err != nil {
+		if e, ok := err.(*adviceError); ok {
+			a := e.advice
+			return &a, true
+		}
+		u, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return nil, false
+		}
+		err = u.Underlying()
+	}
+	return nil, false
+}
+
+// withAdvice attaches Advice of the failed request to err.
+func (s *RegionRequestSender) withAdvice(err error) error {
+	if err == nil {
+		return nil
+	}
+	a := Advice{Effect: EffectNotApplied}
+	if s.maybeApplied {
+		a.Effect = EffectUnknown
+	}
+	cause := errors.Cause(err)
+	switch {
+	case cause == ErrNoPeerAvailable:
+		// The region is dropped, a retry reloads it from PD.
+		a.Retryable = true
+	case cause == context.Canceled || cause == context.DeadlineExceeded:
+	case strings.Contains(err.Error(), txnRetryableMark):
+		// Backoff is exhausted, suggest waiting as long as an average
+		// backoff before retrying.
+		a.Retryable = true
+		if n := len(s.bo.errors); n > 0 {
+			a.Delay = time.Duration(s.bo.totalSleep/n) * time.Millisecond
+		}
+	}
+	return &adviceError{err: err, advice: a}
+}
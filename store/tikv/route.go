@@ -0,0 +1,77 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// RoutePlan tells where the first attempt of a request would be sent.
+type RoutePlan struct {
+	Region  RegionVerID
+	PeerID  uint64
+	StoreID uint64
+	// StoreAddr is the address of the store, DialAddr is the address that
+	// would be dialed, see RegionRequestSender.AddrRewriter.
+	StoreAddr string
+	DialAddr  string
+	// StartKey and EndKey are the range of the region.
+	StartKey []byte
+	EndKey   []byte
+	// Context is the context the request would carry.
+	Context *kvrpcpb.Context
+	// CircuitOpen is set if the circuit breaker of the store is open, so the
+	// request would skip the store and try the next peer.
+	CircuitOpen bool
+	// Limited is set if the request would wait for the limiter of the store,
+	// see SenderConfig.StoreMaxInflight.
+	Limited bool
+}
+
+// Route resolves the target of the first attempt of a KV request the same way
+// SendKVReq does, without sending it. The region cache, circuit breakers and
+// store limiters are not updated, not even if the region has no available
+// peer. It fails as SendKVReq would if the region has no available peer, or
+// too few healthy replicas for a write, see MinHealthyReplicas. It returns nil
+// if the region is not in cache, or the keys of the request are out of the
+// region while CheckKeyRange is set, so SendKVReq would return a `StaleEpoch`
+// error or reload the region as CacheMissPolicy says.
+func (s *RegionRequestSender) Route(req *kvrpcpb.Request, regionID RegionVerID) (*RoutePlan, error) {
+	s.loadConfig()
+	region := s.regionCache.GetRegionByVerID(regionID)
+	if region == nil {
+		return nil, nil
+	}
+	if s.CheckKeyRange && !regionContainsKeys(region, req) {
+		return nil, nil
+	}
+	_, isWrite := requestKeys(req)
+	t, err := s.target(region, req.Size(), isWrite, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &RoutePlan{
+		Region:      region.VerID(),
+		PeerID:      region.peer.GetId(),
+		StoreID:     t.storeID,
+		StoreAddr:   t.storeAddr,
+		DialAddr:    t.dialAddr,
+		StartKey:    region.StartKey(),
+		EndKey:      region.EndKey(),
+		Context:     region.GetContext(),
+		CircuitOpen: t.circuitOpen,
+		Limited:     t.limited,
+	}, nil
+}
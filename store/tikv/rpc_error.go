@@ -0,0 +1,70 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import "github.com/juju/errors"
+
+// RPCError is the error returned by RegionRequestSender. It tells the region
+// of the failed request, and the store and peer that its last attempt is
+// sent to. StoreAddr and PeerID are empty if no attempt is sent.
+type RPCError struct {
+	Region    RegionVerID
+	StoreAddr string
+	PeerID    uint64
+	err       error
+}
+
+func (e *RPCError) Error() string {
+	return e.err.Error()
+}
+
+// Cause implements the causer interface of juju errors.
+func (e *RPCError) Cause() error {
+	return errors.Cause(e.err)
+}
+
+// RPCErrorOf extracts the RPCError of an error returned by
+// RegionRequestSender. ok is false if the error is not returned by it.
+func RPCErrorOf(err error) (rpcErr *RPCError, ok bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case *RPCError:
+			return e, true
+		case *adviceError:
+			err = e.err
+			continue
+		}
+		u, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return nil, false
+		}
+		err = u.Underlying()
+	}
+	return nil, false
+}
+
+// withTarget attaches the region and the peer of the last attempt to err.
+func (s *RegionRequestSender) withTarget(regionID RegionVerID, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RPCError{
+		Region:    regionID,
+		StoreAddr: s.storeAddr,
+		PeerID:    s.peerID,
+		err:       err,
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RPCStats is a snapshot of RuntimeStats.
+type RPCStats struct {
+	// Requests is the number of requests sent by RegionRequestSender, and
+	// RPCs is the number of attempts sent to tikv for them.
+	Requests int
+	RPCs     int
+	// RPCTime is the total wall time of the attempts.
+	RPCTime time.Duration
+	// SendFails is the number of attempts failed to send.
+	SendFails int
+	// Backoff is the total backoff time, keyed by the kind of backoff, e.g.
+	// "regionMiss".
+	Backoff map[string]time.Duration
+	// RegionErrors is the number of region errors, keyed by the kind of
+	// error, e.g. "not_leader".
+	RegionErrors map[string]int
+}
+
+// String formats the stats in one line for logs, e.g. slow query logs.
+func (s RPCStats) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "requests: %d, rpc: %d, rpc_time: %v, send_fail: %d", s.Requests, s.RPCs, s.RPCTime, s.SendFails)
+	if len(s.Backoff) > 0 {
+		keys := make([]string, 0, len(s.Backoff))
+		for k := range s.Backoff {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString(", backoff: {")
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%s: %v", k, s.Backoff[k])
+		}
+		buf.WriteString("}")
+	}
+	if len(s.RegionErrors) > 0 {
+		keys := make([]string, 0, len(s.RegionErrors))
+		for k := range s.RegionErrors {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString(", region_err: {")
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%s: %d", k, s.RegionErrors[k])
+		}
+		buf.WriteString("}")
+	}
+	return buf.String()
+}
+
+// RuntimeStats collects the RPC statistics of all requests sent with a
+// context carrying it, see WithRuntimeStats. It's safe for concurrent use, so
+// one RuntimeStats can collect the requests of a whole query.
+type RuntimeStats struct {
+	mu    sync.Mutex
+	stats RPCStats
+}
+
+// Stats returns a snapshot of the collected statistics.
+func (r *RuntimeStats) Stats() RPCStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.stats
+	s.Backoff = make(map[string]time.Duration, len(r.stats.Backoff))
+	for k, v := range r.stats.Backoff {
+		s.Backoff[k] = v
+	}
+	s.RegionErrors = make(map[string]int, len(r.stats.RegionErrors))
+	for k, v := range r.stats.RegionErrors {
+		s.RegionErrors[k] = v
+	}
+	return s
+}
+
+func (r *RuntimeStats) recordRequest() {
+	r.mu.Lock()
+	r.stats.Requests++
+	r.mu.Unlock()
+}
+
+func (r *RuntimeStats) recordAttempt(d time.Duration, regionErr string, sendFail bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.RPCs++
+	r.stats.RPCTime += d
+	if sendFail {
+		r.stats.SendFails++
+	}
+	if regionErr != "" {
+		if r.stats.RegionErrors == nil {
+			r.stats.RegionErrors = make(map[string]int)
+		}
+		r.stats.RegionErrors[regionErr]++
+	}
+}
+
+func (r *RuntimeStats) recordBackoff(typ backoffType, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stats.Backoff == nil {
+		r.stats.Backoff = make(map[string]time.Duration)
+	}
+	r.stats.Backoff[typ.String()] += d
+}
+
+type runtimeStatsKey struct{}
+
+// WithRuntimeStats returns a context carrying stats, which collects the RPC
+// statistics of the requests sent with the context.
+func WithRuntimeStats(ctx context.Context, stats *RuntimeStats) context.Context {
+	return context.WithValue(ctx, runtimeStatsKey{}, stats)
+}
+
+func runtimeStatsOf(ctx context.Context) *RuntimeStats {
+	s, _ := ctx.Value(runtimeStatsKey{}).(*RuntimeStats)
+	return s
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Security is the TLS config of the connections to tikv. TiKV does not serve
+// TLS itself, so it's meant for stores reached through TLS terminating
+// proxies, see RegionRequestSender.AddrRewriter. Connections to PD are not
+// affected.
+type Security struct {
+	// CAPath is the path of the PEM encoded CA certificates that verify the
+	// server certificates.
+	CAPath string
+	// CertPath and KeyPath are the paths of the PEM encoded client
+	// certificate and key for mutual authentication. Empty means no client
+	// certificate. They are loaded again when either file is modified, so
+	// certificates can be rotated without restarting.
+	CertPath string
+	KeyPath  string
+	// VerifyServerName makes the host of the dialed address be verified
+	// against the server certificate. Otherwise only the certificate chain is
+	// verified, which suits proxies shared by several stores.
+	VerifyServerName bool
+}
+
+type tlsConfigHolder struct {
+	cfg *tls.Config
+}
+
+var globalTLSConfig atomic.Value
+
+// SetSecurity enables TLS for the connections to tikv that are dialed after
+// it's called. Pass nil to disable TLS.
+func SetSecurity(s *Security) error {
+	if s == nil {
+		globalTLSConfig.Store(tlsConfigHolder{})
+		return nil
+	}
+	cfg, err := s.tlsConfig()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	globalTLSConfig.Store(tlsConfigHolder{cfg: cfg})
+	return nil
+}
+
+func getTLSConfig() *tls.Config {
+	h, _ := globalTLSConfig.Load().(tlsConfigHolder)
+	return h.cfg
+}
+
+func (s *Security) tlsConfig() (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(s.CAPath)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read CA %s", s.CAPath)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificate in CA %s", s.CAPath)
+	}
+	cfg := &tls.Config{RootCAs: roots}
+	if s.CertPath != "" || s.KeyPath != "" {
+		kp := &keyPair{certPath: s.CertPath, keyPath: s.KeyPath}
+		if _, err := kp.get(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return kp.get()
+		}
+	}
+	if !s.VerifyServerName {
+		// Verify the chain in VerifyPeerCertificate instead, without the host.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(roots, raw)
+		}
+	}
+	return cfg, nil
+}
+
+func verifyChain(roots *x509.CertPool, raw [][]byte) error {
+	if len(raw) == 0 {
+		return errors.New("no server certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, b := range raw {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return errors.Trace(err)
+}
+
+// keyPair loads a certificate and key, and loads them again when either file
+// is modified.
+type keyPair struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (p *keyPair) get() (*tls.Certificate, error) {
+	modTime, err := latestModTime(p.certPath, p.keyPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cert != nil && !modTime.After(p.modTime) {
+		return p.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(p.certPath, p.keyPath)
+	if err != nil {
+		if p.cert != nil {
+			// The files may be in the middle of being replaced, keep using
+			// the old certificate.
+			return p.cert, nil
+		}
+		return nil, errors.Annotatef(err, "load certificate %s", p.certPath)
+	}
+	p.cert, p.modTime = &cert, modTime
+	return p.cert, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, errors.Trace(err)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// dialTLS is like net.DialTimeout, but also does the TLS handshake within
+// timeout if TLS is enabled by SetSecurity.
+func dialTLS(addr string, timeout time.Duration) (net.Conn, error) {
+	cfg := getTLSConfig()
+	if cfg == nil {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		return conn, errors.Trace(err)
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, cfg)
+	return conn, errors.Trace(err)
+}
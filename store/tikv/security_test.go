@@ -0,0 +1,178 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&testSecuritySuite{})
+
+type testSecuritySuite struct {
+	dir string
+}
+
+func (s *testSecuritySuite) SetUpTest(c *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("", "tikv-security")
+	c.Assert(err, IsNil)
+}
+
+func (s *testSecuritySuite) TearDownTest(c *C) {
+	SetSecurity(nil)
+	os.RemoveAll(s.dir)
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA if
+// parent is nil.
+func newTestCert(c *C, parent *testCert, dnsNames ...string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "tikv-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key in PEM, and returns their paths.
+func (s *testSecuritySuite) write(c *C, name string, cert *testCert) (string, string) {
+	certPath := filepath.Join(s.dir, name+".crt")
+	keyPath := filepath.Join(s.dir, name+".key")
+	err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.der}), 0600)
+	c.Assert(err, IsNil)
+	b, err := x509.MarshalECPrivateKey(cert.key)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600)
+	c.Assert(err, IsNil)
+	return certPath, keyPath
+}
+
+// startTLSServer starts a server that requires client certificates signed by
+// ca.
+func startTLSServer(c *C, ca, server *testCert) net.Listener {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func (s *testSecuritySuite) TestSecurity(c *C) {
+	ca := newTestCert(c, nil)
+	caPath, _ := s.write(c, "ca", ca)
+	certPath, keyPath := s.write(c, "client", newTestCert(c, ca))
+	l := startTLSServer(c, ca, newTestCert(c, ca, "tikv-proxy"))
+	defer l.Close()
+	addr := l.Addr().String()
+
+	// Only the chain is verified.
+	err := SetSecurity(&Security{CAPath: caPath, CertPath: certPath, KeyPath: keyPath})
+	c.Assert(err, IsNil)
+	conn, err := NewConnection(addr, time.Second)
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	// The certificate is for "tikv-proxy" instead of the dialed host.
+	err = SetSecurity(&Security{CAPath: caPath, CertPath: certPath, KeyPath: keyPath, VerifyServerName: true})
+	c.Assert(err, IsNil)
+	_, err = NewConnection(addr, time.Second)
+	c.Assert(err, NotNil)
+
+	// Certificates signed by another CA are rejected.
+	otherPath, _ := s.write(c, "other", newTestCert(c, nil))
+	err = SetSecurity(&Security{CAPath: otherPath, CertPath: certPath, KeyPath: keyPath})
+	c.Assert(err, IsNil)
+	_, err = NewConnection(addr, time.Second)
+	c.Assert(err, NotNil)
+
+	err = SetSecurity(&Security{CAPath: filepath.Join(s.dir, "missing")})
+	c.Assert(err, NotNil)
+}
+
+func (s *testSecuritySuite) TestKeyPairReload(c *C) {
+	ca := newTestCert(c, nil)
+	certPath, keyPath := s.write(c, "client", newTestCert(c, ca))
+	kp := &keyPair{certPath: certPath, keyPath: keyPath}
+	first, err := kp.get()
+	c.Assert(err, IsNil)
+	again, err := kp.get()
+	c.Assert(err, IsNil)
+	c.Assert(again, Equals, first)
+
+	// Rotate the certificate.
+	s.write(c, "client", newTestCert(c, ca))
+	future := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(certPath, future, future), IsNil)
+	rotated, err := kp.get()
+	c.Assert(err, IsNil)
+	c.Assert(rotated, Not(Equals), first)
+
+	// A broken file keeps the old certificate.
+	c.Assert(ioutil.WriteFile(keyPath, []byte("broken"), 0600), IsNil)
+	future = future.Add(time.Minute)
+	c.Assert(os.Chtimes(keyPath, future, future), IsNil)
+	kept, err := kp.get()
+	c.Assert(err, IsNil)
+	c.Assert(kept, Equals, rotated)
+}
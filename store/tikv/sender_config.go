@@ -0,0 +1,245 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// BackoffConfig describes an exponential backoff, see NewBackoffFn.
+type BackoffConfig struct {
+	// Base and Cap are in ms.
+	Base   int
+	Cap    int
+	Jitter int
+	// MaxSleep is the max total sleep time(in ms) of this backoff within a
+	// request, on top of the budget of the request's Backoffer. Zero means
+	// only the Backoffer's budget applies.
+	MaxSleep int
+}
+
+func (c *BackoffConfig) createFn() func() int {
+	return newBackoffSeq(c.Base, c.Cap, c.Jitter)
+}
+
+// SenderConfig holds the settings of RegionRequestSender that can be changed
+// at runtime, for one sender by RegionRequestSender.Reconfigure, for the
+// senders of a RegionCache by RegionCache.ReconfigureSender, or for the rest
+// of the process by ReconfigureSender. All fields are live-reconfigurable: a
+// new config takes effect for requests that start after it is set, while
+// running requests keep the config they started with.
+type SenderConfig struct {
+	// MinRPCTimeout is the lower bound of the timeout of each RPC. Zero means
+	// the timeout given by caller is used as is.
+	MinRPCTimeout time.Duration
+	// TiKVRPCBackoff is used after failing to send a request. Nil means the
+	// default backoff.
+	TiKVRPCBackoff *BackoffConfig
+	// RegionMissBackoff is used when the region has no leader. Nil means the
+	// default backoff.
+	RegionMissBackoff *BackoffConfig
+	// ServerBusyBackoff is used when tikv reports `ServerIsBusy`. Nil means
+	// the default backoff.
+	ServerBusyBackoff *BackoffConfig
+	// PointGetMaxBackoff and CopMaxBackoff are the max total sleep time(in
+	// ms) of the retries of a snapshot Get or BatchGet, and of a coprocessor
+	// task. Zero means 10s for both.
+	PointGetMaxBackoff int
+	CopMaxBackoff      int
+	// NotLeaderDampenWindow enables retrying the cached leader once on the
+	// first `NotLeader` of a region within the window, before trusting the
+	// new leader suggested by tikv. It absorbs brief leadership blips. Zero
+	// disables it.
+	NotLeaderDampenWindow time.Duration
+	// RecycleConnThreshold is the number of consecutive send failures to an
+	// address after which its connections are recycled, see
+	// Client.RecycleConn. Zero disables recycling.
+	RecycleConnThreshold int
+	// ReadCacheTTL and ReadCacheSize enable caching the responses of Get and
+	// RawGet in RegionCache for up to ReadCacheTTL, holding at most
+	// ReadCacheSize responses. Cached responses are invalidated by writes to
+	// the keys sent through RegionRequestSender and by `NotLeader` and
+	// `StaleEpoch` of the region. Raw writes by other clients are not seen
+	// until the cached responses expire. Caching is disabled if either of
+	// them is zero.
+	ReadCacheTTL  time.Duration
+	ReadCacheSize int
+	// ReloadStagger is the window of a random delay before re-sending a
+	// request whose region is just reloaded after `StaleEpoch` or a dropped
+	// region. Requests failed by the same split wake at different times
+	// instead of hitting the new leader all at once. Zero disables it.
+	ReloadStagger time.Duration
+	// BusyTimeoutFactor enables adapting the RPC timeout to busy stores. A
+	// request sent to a store that has reported `ServerIsBusy` recently gets
+	// a timeout of at least BusyTimeoutFactor times the store's average
+	// latency, see RegionCache.StoreLatency, so a slow store is not flooded
+	// with retries of timed out requests. The timeout is unchanged if the
+	// latency is unknown. Zero disables it.
+	BusyTimeoutFactor float64
+	// SlowStoreP99 enables throttling coprocessor tasks sent to slow stores.
+	// One coprocessor request runs at most SlowStoreConcurrency tasks at a
+	// time on a store whose p99 latency exceeds SlowStoreP99, see
+	// RegionCache.StoreLatencyP99, and runs tasks on other stores first.
+	// Zero SlowStoreConcurrency means 1. Zero SlowStoreP99 disables it.
+	SlowStoreP99         time.Duration
+	SlowStoreConcurrency int
+	// CircuitBreakerFailures enables the circuit breakers of stores. After
+	// CircuitBreakerFailures send failures to a store within
+	// CircuitBreakerWindow, requests skip the store and try the next peer
+	// for CircuitBreakerCooldown. Then one request is let through, and the
+	// circuit closes if it succeeds. Zero window and cooldown mean 10s and
+	// 5s. Zero CircuitBreakerFailures disables circuit breakers.
+	CircuitBreakerFailures int
+	CircuitBreakerWindow   time.Duration
+	CircuitBreakerCooldown time.Duration
+	// CircuitBreakerBackgroundProbe keeps requests off a store after the
+	// cooldown too. The circuit is closed only by a successful probe of
+	// HealthSweeper, so no request pays the timeout of a store that is
+	// still down.
+	CircuitBreakerBackgroundProbe bool
+	// CopCacheCapacity enables caching coprocessor responses, holding at
+	// most CopCacheCapacity bytes of response data. Only responses of at
+	// most CopCacheAdmissionMaxSize bytes that take at least
+	// CopCacheAdmissionMinTime are cached. Requests are keyed by the region
+	// version and the request, which carries the read ts, so only identical
+	// requests at the same ts hit, e.g. those of queries run repeatedly with
+	// tidb_snapshot. Zero CopCacheAdmissionMaxSize means 64KB. Zero
+	// CopCacheCapacity disables it.
+	CopCacheCapacity         int
+	CopCacheAdmissionMaxSize int
+	CopCacheAdmissionMinTime time.Duration
+	// StoreMaxInflight and StoreMaxInflightBytes limit the requests in
+	// flight to one store from this client, by number and by the size(in
+	// bytes) of requests. Requests over the limits are queued, and fail at
+	// once with ErrTiKVServerBusy if they are not expected to be sent before
+	// the deadline of their context. The number limit of a store is halved
+	// when it reports `ServerIsBusy`, and grows back by one after as many
+	// requests succeed in a row, so a busy store gets less concurrency
+	// instead of only backed off retries. Zero disables either limit.
+	StoreMaxInflight      int
+	StoreMaxInflightBytes int
+}
+
+var senderConfig atomic.Value
+
+// ReconfigureSender replaces the default config used by RegionRequestSender,
+// for the RegionCaches that have no config of their own.
+func ReconfigureSender(cfg SenderConfig) {
+	senderConfig.Store(&cfg)
+}
+
+// CurrentSenderConfig returns the default config used by new requests.
+func CurrentSenderConfig() SenderConfig {
+	return *loadSenderConfig()
+}
+
+// ReconfigureSender replaces the config used by the senders of the cache,
+// which overrides the default set by the package level ReconfigureSender.
+func (c *RegionCache) ReconfigureSender(cfg SenderConfig) {
+	c.senderCfg.Store(&cfg)
+}
+
+// CurrentSenderConfig returns the config used by new requests of the cache.
+func (c *RegionCache) CurrentSenderConfig() SenderConfig {
+	return *c.senderConfig()
+}
+
+func (c *RegionCache) senderConfig() *SenderConfig {
+	if c != nil {
+		if cfg, ok := c.senderCfg.Load().(*SenderConfig); ok {
+			return cfg
+		}
+	}
+	return loadSenderConfig()
+}
+
+// Reconfigure replaces the config of the sender, which overrides the config
+// of its RegionCache. It takes effect from the next request, so it's safe to
+// call while a request is running.
+func (s *RegionRequestSender) Reconfigure(cfg SenderConfig) {
+	s.cfgOverride.Store(&cfg)
+}
+
+func loadSenderConfig() *SenderConfig {
+	if cfg, ok := senderConfig.Load().(*SenderConfig); ok {
+		return cfg
+	}
+	return &SenderConfig{}
+}
+
+func (c *SenderConfig) rpcTimeout(timeout time.Duration) time.Duration {
+	if timeout < c.MinRPCTimeout {
+		return c.MinRPCTimeout
+	}
+	return timeout
+}
+
+func (c *SenderConfig) readCacheEnabled() bool {
+	return c.ReadCacheTTL > 0 && c.ReadCacheSize > 0
+}
+
+func (c *SenderConfig) circuitBreakerWindow() time.Duration {
+	if c.CircuitBreakerWindow > 0 {
+		return c.CircuitBreakerWindow
+	}
+	return defaultCircuitBreakerWindow
+}
+
+func (c *SenderConfig) circuitBreakerCooldown() time.Duration {
+	if c.CircuitBreakerCooldown > 0 {
+		return c.CircuitBreakerCooldown
+	}
+	return defaultCircuitBreakerCooldown
+}
+
+func (c *SenderConfig) pointGetMaxBackoff(def int) int {
+	if c.PointGetMaxBackoff > 0 {
+		return c.PointGetMaxBackoff
+	}
+	return def
+}
+
+func (c *SenderConfig) copMaxBackoff() int {
+	if c.CopMaxBackoff > 0 {
+		return c.CopMaxBackoff
+	}
+	return copNextMaxBackoff
+}
+
+func (c *SenderConfig) copCacheAdmissionMaxSize() int {
+	if c.CopCacheAdmissionMaxSize > 0 {
+		return c.CopCacheAdmissionMaxSize
+	}
+	return defaultCopCacheAdmissionMaxSize
+}
+
+func (c *SenderConfig) slowStoreConcurrency() int {
+	if c.SlowStoreConcurrency > 0 {
+		return c.SlowStoreConcurrency
+	}
+	return 1
+}
+
+func (c *SenderConfig) backoffConfig(typ backoffType) *BackoffConfig {
+	switch typ {
+	case boTiKVRPC:
+		return c.TiKVRPCBackoff
+	case boRegionMiss:
+		return c.RegionMissBackoff
+	case boServerBusy:
+		return c.ServerBusyBackoff
+	}
+	return nil
+}
@@ -57,7 +57,7 @@ func (s *tikvSnapshot) BatchGet(keys []kv.Key) (map[string][]byte, error) {
 
 	// We want [][]byte instead of []kv.Key, use some magic to save memory.
 	bytesKeys := *(*[][]byte)(unsafe.Pointer(&keys))
-	bo := NewBackoffer(batchGetMaxBackoff, context.Background())
+	bo := NewBackoffer(s.store.regionCache.senderConfig().pointGetMaxBackoff(batchGetMaxBackoff), context.Background())
 
 	// Create a map to collect key-values from region servers.
 	var mu sync.Mutex
@@ -171,7 +171,7 @@ func (s *tikvSnapshot) batchGetSingleRegion(bo *Backoffer, batch batchKeys, coll
 
 // Get gets the value for key k from snapshot.
 func (s *tikvSnapshot) Get(k kv.Key) ([]byte, error) {
-	val, err := s.get(NewBackoffer(getMaxBackoff, context.Background()), k)
+	val, err := s.get(NewBackoffer(s.store.regionCache.senderConfig().pointGetMaxBackoff(getMaxBackoff), context.Background()), k)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -0,0 +1,382 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"golang.org/x/net/context"
+)
+
+const (
+	// storeUnreachableFailures is the number of consecutive send failures
+	// after which a store is considered unreachable.
+	storeUnreachableFailures = 2
+	// storeHealthTTL is how long an unreachable store is remembered if there
+	// is no new failure. After that it's considered reachable again, so a
+	// store that recovers while no request is sent to it is not avoided
+	// forever.
+	storeHealthTTL = 30 * time.Second
+	// storeBusyTTL is how long a store is considered busy after it reports
+	// `ServerIsBusy`.
+	storeBusyTTL = 3 * time.Second
+	// storeLatencySamples is the number of the latest latencies of successful
+	// requests kept for each store, see RegionCache.StoreLatencyP99.
+	storeLatencySamples = 128
+)
+
+type storeHealth struct {
+	failures int
+	lastFail time.Time
+	// latency is the moving average of the latency of successful requests,
+	// zero if no request has succeeded.
+	latency time.Duration
+	// lastBusy is the last time the store reported `ServerIsBusy`.
+	lastBusy time.Time
+	// samples is a ring of the latest latencies, next is where the next one
+	// is put.
+	samples []time.Duration
+	next    int
+}
+
+// p99 returns the 99th percentile of the latency samples, zero if there is
+// none.
+func (h *storeHealth) p99() time.Duration {
+	if len(h.samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(h.samples))
+	copy(sorted, h.samples)
+	sort.Sort(durations(sorted))
+	// Nearest rank.
+	return sorted[(len(sorted)*99+99)/100-1]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// StoreHealthInfo is a summary of the health of a store, see
+// RegionCache.StoreHealths.
+type StoreHealthInfo struct {
+	Reachable bool
+	Busy      bool
+	// Latency is the moving average of the latency of recent successful
+	// requests, and P99 is the 99th percentile of the latest ones. They are
+	// zero if no request has succeeded.
+	Latency time.Duration
+	P99     time.Duration
+}
+
+type storeHealthMap struct {
+	sync.RWMutex
+	m map[uint64]*storeHealth
+}
+
+// StoreReachable returns whether the store is considered reachable by the
+// results of recent requests sent to it, including the probes of
+// HealthSweeper. Stores that have not been sent any request are reachable.
+func (c *RegionCache) StoreReachable(storeID uint64) bool {
+	c.health.RLock()
+	defer c.health.RUnlock()
+
+	h, ok := c.health.m[storeID]
+	if !ok {
+		return true
+	}
+	return h.failures < storeUnreachableFailures || time.Since(h.lastFail) > storeHealthTTL
+}
+
+// StoreLatency returns the moving average of the latency of recent successful
+// requests sent to the store. ok is false if it is unknown.
+func (c *RegionCache) StoreLatency(storeID uint64) (latency time.Duration, ok bool) {
+	c.health.RLock()
+	defer c.health.RUnlock()
+
+	h, ok := c.health.m[storeID]
+	if !ok || h.latency == 0 {
+		return 0, false
+	}
+	return h.latency, true
+}
+
+// StoreLatencyP99 returns the 99th percentile of the latency of the latest
+// successful requests sent to the store. ok is false if it is unknown.
+func (c *RegionCache) StoreLatencyP99(storeID uint64) (p99 time.Duration, ok bool) {
+	c.health.RLock()
+	defer c.health.RUnlock()
+
+	h, ok := c.health.m[storeID]
+	if !ok || len(h.samples) == 0 {
+		return 0, false
+	}
+	return h.p99(), true
+}
+
+// StoreHealths returns the health of the stores that have been sent requests,
+// keyed by store ID.
+func (c *RegionCache) StoreHealths() map[uint64]StoreHealthInfo {
+	c.health.RLock()
+	ids := make([]uint64, 0, len(c.health.m))
+	for id := range c.health.m {
+		ids = append(ids, id)
+	}
+	c.health.RUnlock()
+
+	infos := make(map[uint64]StoreHealthInfo, len(ids))
+	for _, id := range ids {
+		info := StoreHealthInfo{
+			Reachable: c.StoreReachable(id),
+			Busy:      c.StoreBusy(id),
+		}
+		info.Latency, _ = c.StoreLatency(id)
+		info.P99, _ = c.StoreLatencyP99(id)
+		infos[id] = info
+	}
+	return infos
+}
+
+// StoreBusy returns whether the store has reported `ServerIsBusy` recently.
+func (c *RegionCache) StoreBusy(storeID uint64) bool {
+	c.health.RLock()
+	defer c.health.RUnlock()
+
+	h, ok := c.health.m[storeID]
+	return ok && time.Since(h.lastBusy) < storeBusyTTL
+}
+
+// reportStoreBusy records that the store reported `ServerIsBusy`.
+func (c *RegionCache) reportStoreBusy(storeID uint64) {
+	c.health.Lock()
+	defer c.health.Unlock()
+
+	h, ok := c.health.m[storeID]
+	if !ok {
+		h = &storeHealth{}
+		c.health.m[storeID] = h
+	}
+	h.lastBusy = time.Now()
+}
+
+// reportStoreResult records the result of sending a request to the store.
+// latency is ignored if the request failed.
+func (c *RegionCache) reportStoreResult(storeID uint64, latency time.Duration, ok bool) {
+	c.health.Lock()
+	defer c.health.Unlock()
+
+	h, exist := c.health.m[storeID]
+	if !exist {
+		h = &storeHealth{}
+		c.health.m[storeID] = h
+	}
+	if !ok {
+		h.failures++
+		h.lastFail = time.Now()
+		return
+	}
+	h.failures = 0
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		// Weight the new sample by 1/4.
+		h.latency += (latency - h.latency) / 4
+	}
+	if len(h.samples) < storeLatencySamples {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.next] = latency
+	}
+	h.next = (h.next + 1) % storeLatencySamples
+}
+
+// knownStores returns the IDs of the stores that have peers of cached
+// regions.
+func (c *RegionCache) knownStores() []uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	seen := make(map[uint64]struct{})
+	var stores []uint64
+	for _, r := range c.mu.regions {
+		for _, p := range r.meta.GetPeers() {
+			if _, ok := seen[p.GetStoreId()]; !ok {
+				seen[p.GetStoreId()] = struct{}{}
+				stores = append(stores, p.GetStoreId())
+			}
+		}
+	}
+	return stores
+}
+
+// HealthSweepConfig is the config of HealthSweeper.
+type HealthSweepConfig struct {
+	// Interval is the time between the start of two sweeps. Zero means 10s.
+	Interval time.Duration
+	// Concurrency is the max number of stores probed at the same time. It's
+	// at least 1.
+	Concurrency int
+	// ProbeTimeout is the timeout of probing a store. Zero means 2s.
+	ProbeTimeout time.Duration
+	// AddrRewriter translates the address of a store to the address that is
+	// probed, it should be the same as RegionRequestSender.AddrRewriter.
+	// Results are still recorded by the store's own address.
+	AddrRewriter func(storeID uint64, addr string) string
+}
+
+// The defaults of HealthSweepConfig.Interval and HealthSweepConfig.ProbeTimeout.
+const (
+	defaultHealthSweepInterval = 10 * time.Second
+	defaultHealthProbeTimeout  = 2 * time.Second
+)
+
+// HealthSweeper periodically probes the stores that have peers of cached
+// regions, and records the results in the same way as real requests, see
+// RegionCache.StoreReachable and RegionCache.StoreLatency. It keeps the
+// health of stores that are not hit by requests for a while up to date.
+// Stores that PD reports as tombstone or at a new address are invalidated,
+// see RegionCache.InvalidateStore, so requests don't wait for a failure of
+// every Region to find out.
+// Probes also close the half-open circuit breakers of stores that are back,
+// see SenderConfig.CircuitBreakerBackgroundProbe.
+type HealthSweeper struct {
+	cache  *RegionCache
+	client Client
+	cfg    HealthSweepConfig
+	// lastSweep is the UnixNano of the time when the last sweep finished.
+	lastSweep int64
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// NewHealthSweeper creates a HealthSweeper and starts sweeping in background.
+func NewHealthSweeper(cache *RegionCache, client Client, cfg HealthSweepConfig) *HealthSweeper {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultHealthSweepInterval
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = defaultHealthProbeTimeout
+	}
+	s := &HealthSweeper{
+		cache:  cache,
+		client: client,
+		cfg:    cfg,
+		done:   make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.start()
+	return s
+}
+
+// Close stops the background goroutine and waits for it to exit. Running
+// probes are canceled.
+func (s *HealthSweeper) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// LastSweep returns the time when the last sweep finished, zero if no sweep has
+// finished.
+func (s *HealthSweeper) LastSweep() time.Time {
+	if t := atomic.LoadInt64(&s.lastSweep); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+func (s *HealthSweeper) start() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *HealthSweeper) sweep() {
+	stores := s.cache.knownStores()
+	sem := make(chan struct{}, s.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for _, id := range stores {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id uint64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			s.probe(id)
+		}(id)
+	}
+	wg.Wait()
+	if s.ctx.Err() == nil {
+		atomic.StoreInt64(&s.lastSweep, time.Now().UnixNano())
+	}
+}
+
+// probe sends a RawGet without region context to the store. Any response,
+// including a region error, means the store is reachable.
+func (s *HealthSweeper) probe(storeID uint64) {
+	store, err := s.cache.pdClient.GetStore(storeID)
+	if err != nil {
+		log.Warnf("health sweep: failed load store %d: %v", storeID, err)
+		return
+	}
+	if s.cache.storeChanged(store) {
+		n := s.cache.InvalidateStore(storeID)
+		log.Infof("health sweep: store %d is %v at %s, %d regions dropped", storeID, store.GetState(), store.GetAddress(), n)
+		if store.GetState() == metapb.StoreState_Tombstone {
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.ProbeTimeout)
+	defer cancel()
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{},
+	}
+	addr := store.GetAddress()
+	if s.cfg.AddrRewriter != nil {
+		addr = s.cfg.AddrRewriter(storeID, addr)
+	}
+	start := time.Now()
+	_, err = s.client.SendKVReq(ctx, addr, req, s.cfg.ProbeTimeout)
+	if s.ctx.Err() != nil {
+		// Closed, the result is meaningless.
+		return
+	}
+	if err != nil {
+		log.Debugf("health sweep: probe store %d failed: %v", storeID, err)
+	}
+	s.cache.reportStoreResult(storeID, time.Since(start), err == nil)
+	if cfg := s.cache.senderConfig(); cfg.CircuitBreakerFailures > 0 {
+		s.cache.reportCircuitProbe(storeID, err == nil, cfg)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+// storeLimiter limits the requests in flight to a store, see
+// SenderConfig.StoreMaxInflight.
+type storeLimiter struct {
+	// limit is the current max number of requests in flight. It's halved on
+	// `ServerIsBusy`, and grows by one after limit requests succeed in a row,
+	// up to SenderConfig.StoreMaxInflight.
+	limit     int
+	successes int
+	inflight  int
+	bytes     int
+	// waiters are the queued requests, in the order they arrive.
+	waiters *list.List
+}
+
+type limitWaiter struct {
+	size  int
+	ready chan struct{}
+}
+
+type storeLimiterMap struct {
+	sync.Mutex
+	m map[uint64]*storeLimiter
+}
+
+func (m *storeLimiterMap) get(storeID uint64, cfg *SenderConfig) *storeLimiter {
+	l, ok := m.m[storeID]
+	if !ok {
+		l = &storeLimiter{waiters: list.New()}
+		m.m[storeID] = l
+	}
+	if l.limit <= 0 || l.limit > cfg.StoreMaxInflight {
+		l.limit = cfg.StoreMaxInflight
+	}
+	return l
+}
+
+// fits returns whether a request of size bytes can be sent now. A request is
+// always sent to an idle store, even if it is larger than the bytes limit.
+func (l *storeLimiter) fits(size int, cfg *SenderConfig) bool {
+	if l.inflight == 0 {
+		return true
+	}
+	if cfg.StoreMaxInflight > 0 && l.inflight >= l.limit {
+		return false
+	}
+	return cfg.StoreMaxInflightBytes <= 0 || l.bytes+size <= cfg.StoreMaxInflightBytes
+}
+
+func (l *storeLimiter) admit(size int) {
+	l.inflight++
+	l.bytes += size
+}
+
+// wake admits the queued requests that fit, in order.
+func (l *storeLimiter) wake(cfg *SenderConfig) {
+	for e := l.waiters.Front(); e != nil; e = l.waiters.Front() {
+		w := e.Value.(*limitWaiter)
+		if !l.fits(w.size, cfg) {
+			return
+		}
+		l.waiters.Remove(e)
+		l.admit(w.size)
+		close(w.ready)
+	}
+}
+
+// StoreInflight returns the number of requests in flight to the store and
+// its current limit. limit is 0 if the number is not limited.
+func (c *RegionCache) StoreInflight(storeID uint64) (inflight, limit int) {
+	c.limiters.Lock()
+	defer c.limiters.Unlock()
+
+	l, ok := c.limiters.m[storeID]
+	if !ok {
+		return 0, c.senderConfig().StoreMaxInflight
+	}
+	return l.inflight, l.limit
+}
+
+// storeLimited returns whether a request of size bytes to the store would wait
+// for the limiter, without acquiring it.
+func (c *RegionCache) storeLimited(storeID uint64, size int, cfg *SenderConfig) bool {
+	if cfg.StoreMaxInflight <= 0 && cfg.StoreMaxInflightBytes <= 0 {
+		return false
+	}
+	c.limiters.Lock()
+	defer c.limiters.Unlock()
+
+	l, ok := c.limiters.m[storeID]
+	return ok && (l.waiters.Len() > 0 || !l.fits(size, cfg))
+}
+
+// acquireStore waits until a request of size bytes can be sent to the store.
+// If ctx has a deadline, it fails at once with ErrTiKVServerBusy if the wait
+// is expected to pass the deadline, estimated by the latency of the store and
+// the requests queued before.
+func (c *RegionCache) acquireStore(ctx context.Context, storeID uint64, size int, cfg *SenderConfig) error {
+	latency, hasLatency := c.StoreLatency(storeID)
+
+	c.limiters.Lock()
+	l := c.limiters.get(storeID, cfg)
+	if l.waiters.Len() == 0 && l.fits(size, cfg) {
+		l.admit(size)
+		c.limiters.Unlock()
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && hasLatency {
+		slots := l.limit
+		if slots <= 0 {
+			slots = 1
+		}
+		wait := latency * time.Duration(l.waiters.Len()+1) / time.Duration(slots)
+		if time.Now().Add(wait).After(deadline) {
+			queued := l.waiters.Len()
+			c.limiters.Unlock()
+			storeLimiterCounter.WithLabelValues("reject").Inc()
+			return errors.Trace(ErrTiKVServerBusy.Gen("store %d is overloaded, %d requests queued, expected wait %v exceeds the deadline", storeID, queued, wait))
+		}
+	}
+	w := &limitWaiter{size: size, ready: make(chan struct{})}
+	e := l.waiters.PushBack(w)
+	c.limiters.Unlock()
+	storeLimiterCounter.WithLabelValues("queue").Inc()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	c.limiters.Lock()
+	defer c.limiters.Unlock()
+	select {
+	case <-w.ready:
+		// It's admitted just before giving up.
+		l.inflight--
+		l.bytes -= size
+	default:
+		l.waiters.Remove(e)
+	}
+	l.wake(cfg)
+	return errors.Trace(ctx.Err())
+}
+
+// releaseStore is called after a request acquired by acquireStore is done. ok
+// is whether a response is received, and busy is whether it's `ServerIsBusy`.
+func (c *RegionCache) releaseStore(storeID uint64, size int, ok, busy bool, cfg *SenderConfig) {
+	c.limiters.Lock()
+	defer c.limiters.Unlock()
+
+	l := c.limiters.get(storeID, cfg)
+	l.inflight--
+	l.bytes -= size
+	switch {
+	case busy:
+		if l.limit > 1 {
+			l.limit /= 2
+		}
+		l.successes = 0
+		storeLimiterCounter.WithLabelValues("decrease").Inc()
+	case ok && l.limit < cfg.StoreMaxInflight:
+		l.successes++
+		if l.successes >= l.limit {
+			l.limit++
+			l.successes = 0
+		}
+	}
+	l.wake(cfg)
+}
+
+// acquireStore waits for the limiter of the store if it's enabled. release
+// must be called with the result after the request is done.
+func (s *RegionRequestSender) acquireStore(storeID uint64, size int) (release func(ok, busy bool), err error) {
+	cfg := s.cfg
+	if cfg.StoreMaxInflight <= 0 && cfg.StoreMaxInflightBytes <= 0 {
+		return func(bool, bool) {}, nil
+	}
+	if err = s.regionCache.acquireStore(s.bo.ctx, storeID, size, cfg); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return func(ok, busy bool) {
+		s.regionCache.releaseStore(storeID, size, ok, busy, cfg)
+	}, nil
+}
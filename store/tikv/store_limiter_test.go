@@ -0,0 +1,99 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"golang.org/x/net/context"
+)
+
+func (s *testRegionRequestSuite) TestStoreLimiter(c *C) {
+	cfg := &SenderConfig{StoreMaxInflight: 1, StoreMaxInflightBytes: 10}
+	ctx := context.Background()
+
+	// A request larger than the bytes limit is sent to an idle store.
+	c.Assert(s.cache.acquireStore(ctx, s.store, 100, cfg), IsNil)
+	s.cache.releaseStore(s.store, 100, true, false, cfg)
+
+	c.Assert(s.cache.acquireStore(ctx, s.store, 1, cfg), IsNil)
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- s.cache.acquireStore(ctx, s.store, 1, cfg)
+	}()
+	select {
+	case <-acquired:
+		c.Fatal("acquired over the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.cache.releaseStore(s.store, 1, true, false, cfg)
+	c.Assert(<-acquired, IsNil)
+	inflight, limit := s.cache.StoreInflight(s.store)
+	c.Assert(inflight, Equals, 1)
+	c.Assert(limit, Equals, 1)
+
+	// A canceled request leaves the queue.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		acquired <- s.cache.acquireStore(cancelCtx, s.store, 1, cfg)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	c.Assert(errors.Cause(<-acquired), Equals, context.Canceled)
+	c.Assert(s.cache.limiters.m[s.store].waiters.Len(), Equals, 0)
+
+	// A request that can't be sent before its deadline is rejected at once.
+	s.cache.reportStoreResult(s.store, time.Second, true)
+	deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.cache.acquireStore(deadlineCtx, s.store, 1, cfg)
+	c.Assert(ErrTiKVServerBusy.Equal(err), IsTrue)
+	c.Assert(time.Since(start) < 50*time.Millisecond, IsTrue)
+	s.cache.releaseStore(s.store, 1, true, false, cfg)
+}
+
+func (s *testRegionRequestSuite) TestStoreLimiterBusy(c *C) {
+	defer ReconfigureSender(CurrentSenderConfig())
+	ReconfigureSender(SenderConfig{
+		StoreMaxInflight:  8,
+		ServerBusyBackoff: &BackoffConfig{Base: 1, Cap: 1, Jitter: NoJitter},
+	})
+
+	region, err := s.cache.GetRegion(s.bo, []byte("key"))
+	c.Assert(err, IsNil)
+	req := &kvrpcpb.Request{
+		Type:         kvrpcpb.MessageType_CmdRawGet,
+		CmdRawGetReq: &kvrpcpb.CmdRawGetRequest{Key: []byte("key")},
+	}
+	busy := &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}
+	client := &regionErrClient{Client: s.client, errs: []*errorpb.Error{busy, busy}}
+	_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+	c.Assert(err, IsNil)
+	inflight, limit := s.cache.StoreInflight(s.store)
+	c.Assert(inflight, Equals, 0)
+	c.Assert(limit, Equals, 2)
+
+	// The limit grows by one after as many successes.
+	for i := 0; i < 2; i++ {
+		_, err = NewRegionRequestSender(s.bo, s.cache, client).SendKVReq(req, region.VerID(), readTimeoutShort)
+		c.Assert(err, IsNil)
+	}
+	_, limit = s.cache.StoreInflight(s.store)
+	c.Assert(limit, Equals, 3)
+}
@@ -49,16 +49,22 @@ func (s *testStoreSuite) SetUpTest(c *C) {
 }
 
 func (s *testStoreSuite) TestParsePath(c *C) {
-	etcdAddrs, disableGC, err := parsePath("tikv://node1:2379,node2:2379")
+	etcdAddrs, disableGC, latchSlots, err := parsePath("tikv://node1:2379,node2:2379")
 	c.Assert(err, IsNil)
 	c.Assert(etcdAddrs, DeepEquals, []string{"node1:2379", "node2:2379"})
 	c.Assert(disableGC, IsFalse)
+	c.Assert(latchSlots, Equals, 0)
 
-	_, _, err = parsePath("tikv://node1:2379")
+	_, _, _, err = parsePath("tikv://node1:2379")
 	c.Assert(err, IsNil)
-	_, disableGC, err = parsePath("tikv://node1:2379?disableGC=true")
+	_, disableGC, _, err = parsePath("tikv://node1:2379?disableGC=true")
 	c.Assert(err, IsNil)
 	c.Assert(disableGC, IsTrue)
+	_, _, latchSlots, err = parsePath("tikv://node1:2379?txnLocalLatches=1024")
+	c.Assert(err, IsNil)
+	c.Assert(latchSlots, Equals, 1024)
+	_, _, _, err = parsePath("tikv://node1:2379?txnLocalLatches=-1")
+	c.Assert(err, NotNil)
 }
 
 func (s *testStoreSuite) TestOracle(c *C) {
@@ -245,7 +251,11 @@ func (c *busyClient) Close() error {
 	return c.client.Close()
 }
 
-func (c *busyClient) SendKVReq(addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
+func (c *busyClient) RecycleConn(addr string) {
+	c.client.RecycleConn(addr)
+}
+
+func (c *busyClient) SendKVReq(ctx context.Context, addr string, req *kvrpcpb.Request, timeout time.Duration) (*kvrpcpb.Response, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
@@ -256,10 +266,10 @@ func (c *busyClient) SendKVReq(addr string, req *kvrpcpb.Request, timeout time.D
 			},
 		}, nil
 	}
-	return c.client.SendKVReq(addr, req, timeout)
+	return c.client.SendKVReq(ctx, addr, req, timeout)
 }
 
-func (c *busyClient) SendCopReq(addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error) {
+func (c *busyClient) SendCopReq(ctx context.Context, addr string, req *coprocessor.Request, timeout time.Duration) (*coprocessor.Response, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
@@ -270,7 +280,7 @@ func (c *busyClient) SendCopReq(addr string, req *coprocessor.Request, timeout t
 			},
 		}, nil
 	}
-	return c.client.SendCopReq(addr, req, timeout)
+	return c.client.SendCopReq(ctx, addr, req, timeout)
 }
 
 type mockPDClient struct {
@@ -0,0 +1,120 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/errorpb"
+)
+
+// Kinds of RetrySegment.
+const (
+	SegmentAttempt = "attempt"
+	SegmentBackoff = "backoff"
+)
+
+// RetrySegment is a phase of a request, see RegionRequestSender.RecordTimeline.
+type RetrySegment struct {
+	Kind  string
+	Start time.Time
+	End   time.Time
+	// StoreAddr is the store that an attempt is sent to.
+	StoreAddr string
+	// Outcome is "success", "send_fail" or the region error label of an
+	// attempt, or the backoff type of a backoff.
+	Outcome string
+}
+
+// Timeline returns the phases of the last request in order. It is empty
+// unless RecordTimeline is set. It's not attached to the slow query log,
+// which has no access to the senders of a statement, so callers that want it
+// logged have to log it themselves.
+func (s *RegionRequestSender) Timeline() []RetrySegment {
+	return s.timeline
+}
+
+// Roles of PeerAttempt.
+const (
+	RoleUnknown  = "unknown"
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// PeerAttempt is an attempt of a request on a peer, see AttemptedPeers.
+type PeerAttempt struct {
+	PeerID    uint64
+	StoreID   uint64
+	StoreAddr string
+	// Role is the role of the peer learned from the attempt: RoleLeader if
+	// it served the request, RoleFollower if it reported `NotLeader`, or
+	// RoleUnknown otherwise.
+	Role string
+	// Outcome is "success", "send_fail" or the region error label.
+	Outcome string
+}
+
+// AttemptedPeers returns the peers that the last request was sent to in order,
+// whether the request succeeded or not.
+func (s *RegionRequestSender) AttemptedPeers() []PeerAttempt {
+	return s.attempts
+}
+
+func (s *RegionRequestSender) recordAttempt(region *Region, start time.Time, regionErr *errorpb.Error, err error) {
+	outcome, role := "success", RoleLeader
+	if err != nil {
+		outcome, role = "send_fail", RoleUnknown
+	} else if regionErr != nil {
+		outcome, role = regionErrorLabel(regionErr), RoleUnknown
+		if regionErr.GetNotLeader() != nil {
+			role = RoleFollower
+		}
+	}
+	if s.runtimeStats != nil {
+		var label string
+		if err == nil && regionErr != nil {
+			label = outcome
+		}
+		s.runtimeStats.recordAttempt(time.Since(start), label, err != nil)
+	}
+	s.attempts = append(s.attempts, PeerAttempt{
+		PeerID:    region.peer.GetId(),
+		StoreID:   region.peer.GetStoreId(),
+		StoreAddr: s.storeAddr,
+		Role:      role,
+		Outcome:   outcome,
+	})
+	if !s.RecordTimeline {
+		return
+	}
+	s.timeline = append(s.timeline, RetrySegment{
+		Kind:      SegmentAttempt,
+		Start:     start,
+		End:       time.Now(),
+		StoreAddr: s.storeAddr,
+		Outcome:   outcome,
+	})
+}
+
+func (s *RegionRequestSender) recordBackoff(start time.Time, typ backoffType) {
+	if !s.RecordTimeline {
+		return
+	}
+	s.timeline = append(s.timeline, RetrySegment{
+		Kind:    SegmentBackoff,
+		Start:   start,
+		End:     time.Now(),
+		Outcome: typ.String(),
+	})
+}
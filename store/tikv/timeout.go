@@ -0,0 +1,90 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// The extra timeout for each key or row a request works on.
+const (
+	timeoutPerKey   = time.Millisecond
+	timeoutPerRange = 100 * time.Millisecond
+)
+
+// KVTimeoutEstimator returns the timeout of a KV request whose caller does not
+// give one.
+type KVTimeoutEstimator func(req *kvrpcpb.Request) time.Duration
+
+// CopTimeoutEstimator returns the timeout of a coprocessor request whose
+// caller does not give one.
+type CopTimeoutEstimator func(req *coprocessor.Request) time.Duration
+
+// DefaultKVTimeout is the default KVTimeoutEstimator. Requests on keys get
+// readTimeoutShort plus timeoutPerKey for each key, up to readTimeoutMedium.
+// Scans get the same for each row of their limit, up to readTimeoutLong.
+// Requests that may scan a whole region get readTimeoutMedium or
+// readTimeoutLong, like their callers give.
+func DefaultKVTimeout(req *kvrpcpb.Request) time.Duration {
+	switch req.GetType() {
+	case kvrpcpb.MessageType_CmdScan:
+		if limit := req.GetCmdScanReq().GetLimit(); limit > 0 {
+			return scaleTimeout(readTimeoutShort, timeoutPerKey, int(limit), readTimeoutLong)
+		}
+		return readTimeoutMedium
+	case kvrpcpb.MessageType_CmdScanLock:
+		return readTimeoutMedium
+	case kvrpcpb.MessageType_CmdResolveLock, kvrpcpb.MessageType_CmdGC:
+		return readTimeoutLong
+	}
+	keys, _ := requestKeys(req)
+	return scaleTimeout(readTimeoutShort, timeoutPerKey, len(keys), readTimeoutMedium)
+}
+
+// DefaultCopTimeout is the default CopTimeoutEstimator. It gives
+// readTimeoutMedium, and timeoutPerRange more for each key range, up to
+// readTimeoutLong.
+func DefaultCopTimeout(req *coprocessor.Request) time.Duration {
+	return scaleTimeout(readTimeoutMedium, timeoutPerRange, len(req.GetRanges()), readTimeoutLong)
+}
+
+func scaleTimeout(base, per time.Duration, n int, max time.Duration) time.Duration {
+	if t := base + per*time.Duration(n); t < max {
+		return t
+	}
+	return max
+}
+
+func (s *RegionRequestSender) kvTimeout(req *kvrpcpb.Request, timeout time.Duration) time.Duration {
+	if timeout != 0 {
+		return timeout
+	}
+	if s.KVTimeoutEstimator != nil {
+		return s.KVTimeoutEstimator(req)
+	}
+	return DefaultKVTimeout(req)
+}
+
+func (s *RegionRequestSender) copTimeout(req *coprocessor.Request, timeout time.Duration) time.Duration {
+	if timeout != 0 {
+		return timeout
+	}
+	if s.CopTimeoutEstimator != nil {
+		return s.CopTimeoutEstimator(req)
+	}
+	return DefaultCopTimeout(req)
+}
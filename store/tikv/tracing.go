@@ -0,0 +1,111 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"golang.org/x/net/context"
+)
+
+// Names of the spans started by RegionRequestSender.
+const (
+	SpanSendKVReq  = "tikv.SendKVReq"
+	SpanSendCopReq = "tikv.SendCopReq"
+	SpanAttempt    = "tikv.attempt"
+	SpanBackoff    = "tikv.backoff"
+)
+
+// Tracer starts the spans of requests sent by RegionRequestSender. It's meant
+// to be adapted to a distributed tracer such as OpenTracing by the caller.
+type Tracer interface {
+	// StartSpan starts a span named op, as a child of the span carried by
+	// ctx if there is one. It returns the span and a context carrying it.
+	StartSpan(ctx context.Context, op string) (Span, context.Context)
+}
+
+// Span is a span started by Tracer.
+type Span interface {
+	SetTag(key string, value interface{})
+	Finish()
+}
+
+type tracerHolder struct {
+	tracer Tracer
+}
+
+var globalTracer atomic.Value
+
+// SetTracer sets the tracer of all requests sent by RegionRequestSender. A
+// span is started for each request, and child spans are started for its
+// attempts and backoffs. Pass nil to disable tracing.
+func SetTracer(t Tracer) {
+	globalTracer.Store(tracerHolder{tracer: t})
+}
+
+func getTracer() Tracer {
+	h, _ := globalTracer.Load().(tracerHolder)
+	return h.tracer
+}
+
+func (s *RegionRequestSender) startSpan(op string, regionID RegionVerID) {
+	s.span, s.spanCtx = nil, nil
+	t := getTracer()
+	if t == nil {
+		return
+	}
+	s.span, s.spanCtx = t.StartSpan(s.bo.ctx, op)
+	s.span.SetTag("region_id", regionID.id)
+}
+
+func (s *RegionRequestSender) finishSpan(regionErr *errorpb.Error, err error) {
+	if s.span == nil {
+		return
+	}
+	s.span.SetTag("retries", s.retries)
+	finishSpan(s.span, regionErr, err)
+	s.span, s.spanCtx = nil, nil
+}
+
+// childSpan starts a child span of the running request, nil if the request
+// is not traced.
+func (s *RegionRequestSender) childSpan(op string) Span {
+	if s.span == nil {
+		return nil
+	}
+	span, _ := getTracer().StartSpan(s.spanCtx, op)
+	return span
+}
+
+func (s *RegionRequestSender) finishAttemptSpan(span Span, regionErr *errorpb.Error, err error) {
+	if span == nil {
+		return
+	}
+	span.SetTag("store_addr", s.storeAddr)
+	span.SetTag("peer_id", s.peerID)
+	span.SetTag("retry", s.retries)
+	finishSpan(span, regionErr, err)
+}
+
+func finishSpan(span Span, regionErr *errorpb.Error, err error) {
+	span.SetTag("success", err == nil && regionErr == nil)
+	if regionErr != nil {
+		span.SetTag("region_error", regionErrorLabel(regionErr))
+	}
+	if err != nil {
+		span.SetTag("error", err.Error())
+	}
+	span.Finish()
+}
@@ -131,6 +131,13 @@ func (txn *tikvTxn) Commit() error {
 	if committer == nil {
 		return nil
 	}
+	if latches := txn.store.txnLatches; latches != nil {
+		lock, err := latches.acquire(txn.StartTS(), committer.keys)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer func() { latches.release(lock, txn.commitTS) }()
+	}
 	err = committer.execute()
 	if err != nil {
 		committer.writeFinishBinlog(binlog.BinlogType_Rollback, 0)
@@ -76,6 +76,7 @@ const (
 	ClassXEval
 	ClassTable
 	ClassTypes
+	ClassTiKV
 	// Add more as needed.
 )
 
@@ -118,6 +119,8 @@ func (ec ErrClass) String() string {
 		return "table"
 	case ClassTypes:
 		return "types"
+	case ClassTiKV:
+		return "tikv"
 	}
 	return strconv.Itoa(int(ec))
 }